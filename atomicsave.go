@@ -0,0 +1,78 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Time after a rename during which a create in the same directory is
+// taken as part of an atomic save.
+const atomicSaveWindow = time.Second
+
+// Suffixes and prefixes of the temporary files editors write while
+// saving: vim swap and backup files, JetBrains safe write files, emacs
+// lock files and gedit output streams.
+var (
+	tempSuffixes = []string{"~", ".swp", ".swx", ".swo", ".tmp", "___jb_tmp___", "___jb_old___"}
+	tempPrefixes = []string{".#", ".goutputstream-"}
+)
+
+// IsTempFile reports whether path looks like a temporary file written by
+// an editor while saving.
+func IsTempFile(path string) bool {
+	name := filepath.Base(path)
+	// Written by vim to check if a directory is writable
+	if name == "4913" {
+		return true
+	}
+	for _, s := range tempSuffixes {
+		if strings.HasSuffix(name, s) {
+			return true
+		}
+	}
+	for _, p := range tempPrefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// coalesce recognizes the events of an atomic save, where editors write
+// a temporary file and rename it over the target, or rename the target
+// away and create it again. Events on temporary files are dropped, and
+// the create of the target right after a rename in its directory becomes
+// a write of it. It returns the event to handle, and false if the event
+// must be dropped.
+func (w *Watcher) coalesce(ev Event) (Event, bool) {
+	now := time.Now()
+	for p, t := range w.renamed {
+		if now.Sub(t) > atomicSaveWindow {
+			delete(w.renamed, p)
+		}
+	}
+	path := normalizePath(ev.Name)
+	if ev.Op == "rename" {
+		w.renamed[path] = now
+	}
+	if IsTempFile(path) {
+		w.verbosef(2, "Ignoring event %s on a temporary file", ev)
+		return ev, false
+	}
+	if ev.Op != "create" {
+		return ev, true
+	}
+	for p := range w.renamed {
+		if filepath.Dir(p) != filepath.Dir(path) {
+			continue
+		}
+		// The target itself, or a temporary copy of it
+		if p == path || strings.HasPrefix(filepath.Base(p), filepath.Base(path)) || IsTempFile(p) {
+			delete(w.renamed, p)
+			w.verbosef(2, "%s replaced by an atomic save, handling it as a write", path)
+			return Event{Name: ev.Name, Op: "write"}, true
+		}
+	}
+	return ev, true
+}
@@ -0,0 +1,682 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// Time to wait after SIGTERM before sending SIGKILL to a command, unless
+// --grace is given, and extra time to wait for its output to be closed.
+const killGrace = 5 * time.Second
+
+// Type Change describes the path that triggered the command, and is
+// used to expand the placeholders in it.
+type Change struct {
+	Path string
+	Dir  string
+	Name string
+	Ext  string
+	// Pattern, or path given with --files, that matched the path
+	MatchedPattern string
+	// Index of the rule running, with --rule
+	Rule int
+	// File with the changed files, one per line, with --files-tmpfile in
+	// batch mode
+	FileList string
+}
+
+// NewChange returns the Change details for path.
+func NewChange(path string) Change {
+	return Change{
+		Path: path,
+		Dir:  filepath.Dir(path),
+		Name: filepath.Base(path),
+		Ext:  filepath.Ext(path),
+	}
+}
+
+// Expand replaces the placeholders in command with the change details.
+// Commands without placeholders are returned unmodified.
+func (ch Change) Expand(command string) (string, error) {
+	if !strings.Contains(command, "{{") {
+		return command, nil
+	}
+	t, err := template.New("command").Parse(command)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, ch); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// execute runs the command for an event on path, and reports whether it
+// did. With --rule, the commands of all rules matching path, or any of
+// the files in batch mode, are run instead, in the order they were
+// given, and the last error is returned. With --first-match, only the
+// first rule matching path runs, and in batch mode each file is given
+// to the first rule matching it. Must be called with runMu held.
+func (w *Watcher) execute(path, event string, files []string) (bool, error) {
+	if w.isPaused() {
+		w.verbosef(2, "Not running for %s, paused after %d failed runs", path, w.opts.FailFast)
+		return false, nil
+	}
+	if len(w.opts.Rules) == 0 {
+		if w.opts.DebouncePerCommand && !w.ruleReady(0, path, event, files) {
+			return false, nil
+		}
+		return true, w.executeRule(0, w.opts.Command, path, event, files)
+	}
+	ran := false
+	var err error
+	claimed := make(map[string]bool)
+	for i, r := range w.opts.Rules {
+		rpath, rfiles := path, files
+		if files != nil {
+			rfiles = nil
+			for _, f := range files {
+				if !claimed[f] && r.Match(f) {
+					rfiles = append(rfiles, f)
+				}
+			}
+			if len(rfiles) == 0 {
+				continue
+			}
+			rpath = rfiles[len(rfiles)-1]
+			if w.opts.FirstMatch {
+				for _, f := range rfiles {
+					claimed[f] = true
+				}
+			}
+		} else if path != "" && !r.Match(path) {
+			// Runs at startup have no path, and match all rules
+			continue
+		} else if path != "" && w.opts.FirstMatch && ran {
+			break
+		}
+		if w.opts.DebouncePerCommand && !w.ruleReady(i, rpath, event, rfiles) {
+			continue
+		}
+		ran = true
+		if e := w.executeRule(i, w.ruleCommand(i), rpath, event, rfiles); e != nil {
+			err = e
+		}
+	}
+	if !ran {
+		w.verbosef(2, "No rule matches %s", path)
+	}
+	return ran, err
+}
+
+// executeRule runs command, of the rule with index rule, for an event on
+// path. The change details are exported to the command as environment
+// variables: WHENCHANGE_PATH with the path, WHENCHANGE_EVENT with the
+// event type, and WHENCHANGE_FILES with all the files changed, one per
+// line, in batch mode. Must be called with runMu held.
+func (w *Watcher) executeRule(rule int, command []string, path, event string, files []string) error {
+	started := false
+	if w.opts.DebouncePerCommand {
+		// Only a started command finishes, and lets the next change run it
+		defer func() {
+			if !started {
+				w.ruleNotStarted(rule)
+			}
+		}()
+	}
+	if len(command) == 0 && w.opts.CommandFile == "" {
+		infof("run", nil, "No command to run.")
+		return nil
+	}
+	pattern := w.patternOf(path)
+	if w.opts.AbsolutePaths {
+		path = absPath(path)
+		if files != nil {
+			abs := make([]string, len(files))
+			for i, f := range files {
+				abs[i] = absPath(f)
+			}
+			files = abs
+		}
+	}
+	env := map[string]string{
+		"WHENCHANGE_PATH":  path,
+		"WHENCHANGE_EVENT": event,
+	}
+	ch := NewChange(path)
+	ch.MatchedPattern, ch.Rule = pattern, rule
+	if files != nil {
+		env["WHENCHANGE_FILES"] = strings.Join(files, "\n")
+		if w.opts.FilesTmpfile {
+			name, err := newFileList()
+			if err != nil {
+				errorf("run", Fields{"error": err.Error()}, "Unable to create the file list: %v", err)
+				return err
+			}
+			env["WHENCHANGE_FILELIST"], ch.FileList = name, name
+		}
+	}
+	c, err := w.ExpandCommand(command, ch)
+	if err != nil {
+		errorf("run", Fields{"error": err.Error()}, "Invalid command template: %v", err)
+		removeFileList(env)
+		return err
+	}
+	started = true
+	return w.RunCommand(rule, c, env)
+}
+
+// absPath returns path as an absolute path, or as it is if empty, as for
+// runs at startup, or if that fails.
+func absPath(path string) string {
+	if path == "" {
+		return path
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// ExpandCommand replaces the placeholders in the arguments of cmd with
+// the details of ch. Unless --no-shell is given, the arguments are joined
+// into a single shell command first.
+func (w *Watcher) ExpandCommand(cmd []string, ch Change) ([]string, error) {
+	if !w.opts.NoShell && len(cmd) > 0 {
+		cmd = []string{strings.Join(cmd, " ")}
+	}
+	expanded := make([]string, len(cmd))
+	for i, arg := range cmd {
+		var err error
+		if expanded[i], err = ch.Expand(arg); err != nil {
+			return nil, err
+		}
+	}
+	return expanded, nil
+}
+
+// ShellArgs returns the program and arguments used to run cmd: the
+// shell with the command string, or cmd itself when --no-shell is given.
+// The --command-file script, if any, is run in place of cmd.
+func (w *Watcher) ShellArgs(cmd []string) (string, []string) {
+	switch {
+	case w.opts.CommandFile != "" && w.opts.NoShell:
+		return w.opts.CommandFile, nil
+	case w.opts.CommandFile != "":
+		return w.opts.Shell, []string{w.opts.CommandFile}
+	case w.opts.NoShell:
+		return cmd[0], cmd[1:]
+	}
+	return w.opts.Shell, w.shellLine(strings.Join(cmd, " "))
+}
+
+// shellLine returns the arguments for the shell to run the command line
+// given: the --shell-args followed by line.
+func (w *Watcher) shellLine(line string) []string {
+	return append(append([]string(nil), w.opts.ShellArgs...), line)
+}
+
+// Function used to create the command processes, so that tests can
+// replace it with a fake.
+var execCommand = exec.CommandContext
+
+// runCommand runs cmd, as returned by ExpandCommand for the rule with
+// index rule, with the variables in env added to the environment. It
+// waits for the command to finish, unless --restart or --parallel is
+// given, and returns its error. Must be called with runMu held.
+func (w *Watcher) runCommand(rule int, cmd []string, env map[string]string) error {
+	if w.opts.DryRun {
+		name, args := w.ShellArgs(cmd)
+		line := quoteArgs(append([]string{name}, args...))
+		infof("dry-run", Fields{"path": env["WHENCHANGE_PATH"], "type": env["WHENCHANGE_EVENT"], "command": line},
+			"Would run: %s", line)
+		removeFileList(env)
+		return nil
+	}
+	// With --once there is no next run to restart for, or to run at the
+	// same time
+	background := w.opts.Restart && !w.opts.Once
+	if background {
+		w.stopRunning(rule)
+	} else if w.opts.Parallel > 1 && !w.opts.Once {
+		w.workers.Add(1)
+		go func() {
+			defer w.workers.Done()
+			select {
+			case w.slots <- struct{}{}:
+			default:
+				w.verbosef(1, "%d commands running, waiting for one to finish", w.opts.Parallel)
+				select {
+				case w.slots <- struct{}{}:
+				case <-w.quit:
+					removeFileList(env)
+					return
+				}
+			}
+			defer func() { <-w.slots }()
+			w.startCommand(rule, cmd, env, false)
+			if w.opts.DebouncePerCommand {
+				w.ruleFinished(rule)
+			}
+		}()
+		return nil
+	}
+	return w.startCommand(rule, cmd, env, background)
+}
+
+// startCommand starts cmd for the rule with index rule, like runCommand,
+// and waits for it to finish unless background is set. Must be called
+// with runMu held when running in the background.
+func (w *Watcher) startCommand(rule int, cmd []string, env map[string]string, background bool) error {
+	if err := writeFileList(env); err != nil {
+		errorf("run", Fields{"path": env["WHENCHANGE_PATH"], "error": err.Error()}, "Unable to write the file list: %v", err)
+		w.recordExit(err)
+		return err
+	}
+	if err := w.runHook("pre", w.opts.Pre, env); err != nil {
+		// Without its setup, the command is not run
+		w.recordExit(err)
+		removeFileList(env)
+		return err
+	}
+	stdin, err := w.commandStdin(env)
+	if err != nil {
+		errorf("run", Fields{"path": env["WHENCHANGE_PATH"], "error": err.Error()}, "Unable to read the stdin file: %v", err)
+		w.recordExit(err)
+		removeFileList(env)
+		return err
+	}
+	name, args := w.ShellArgs(cmd)
+	fields := Fields{"path": env["WHENCHANGE_PATH"], "type": env["WHENCHANGE_EVENT"]}
+	command := strings.Join(cmd, " ")
+	if w.opts.CommandFile != "" {
+		command = w.opts.CommandFile
+		fields["command"] = command
+		infof("run", fields, "Running command file '%s' ...", command)
+	} else {
+		fields["command"] = command
+		infof("run", fields, "Running command '%s' ...", command)
+	}
+	ctx, cancel := w.commandContext()
+	c := execCommand(ctx, name, args...)
+	c.Dir = w.opts.WorkingDir
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	if w.opts.Prefix != "" || w.opts.Parallel > 1 {
+		stdout := &prefixWriter{w: os.Stdout, prefix: []byte(w.opts.Prefix)}
+		stderr := &prefixWriter{w: os.Stderr, prefix: []byte(w.opts.Prefix)}
+		if w.opts.Parallel > 1 && !background {
+			stdout.mu, stderr.mu = &w.outputMu, &w.outputMu
+		}
+		c.Stdout, c.Stderr = stdout, stderr
+		// The output is copied until closed, don't wait forever for
+		// children left behind that keep it open
+		c.WaitDelay = w.opts.Grace + killGrace
+	}
+	term := w.attachPTY(c)
+	c.Env = w.commandEnv(env)
+	c.Stdin = stdin
+	// Only for the hooks run after it
+	env = withVars(env, "WHENCHANGE_COMMAND", command)
+	// Closed once the command exits
+	waited := make(chan struct{})
+	if w.opts.Timeout > 0 {
+		// Make sure the children are stopped as well on timeout
+		setProcessGroup(c)
+		c.Cancel = func() error {
+			go terminate(c, w.opts.Grace, waited)
+			return nil
+		}
+	}
+	path := env["WHENCHANGE_PATH"]
+	if background {
+		w.startRunning(rule, ctx, cancel, c, waited, env, term)
+		return nil
+	}
+	defer cancel()
+	start := time.Now()
+	if err := c.Start(); err != nil {
+		term.Close(0)
+		logExit(err, time.Since(start))
+		w.commandDone(path, start, err)
+		w.runAfter(env, err)
+		return err
+	}
+	w.commandStarted()
+	// If asked to quit while the command runs, stop it first
+	exited := make(chan struct{})
+	go func() {
+		err = w.waitCommand(ctx, c, start, waited, term)
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-w.quit:
+		terminate(c, w.opts.Grace, exited)
+	}
+	w.commandDone(path, start, err)
+	w.runAfter(env, err)
+	return err
+}
+
+// commandStdin returns the stdin for the command run with the variables
+// in env: the changed files with --files-to-stdin in batch mode, the
+// contents of the --stdin-file, or the stdin of whenchange with
+// --stdin-null=false. It returns nil otherwise, for /dev/null.
+func (w *Watcher) commandStdin(env map[string]string) (io.Reader, error) {
+	if files, ok := env["WHENCHANGE_FILES"]; ok && w.opts.FilesToStdin {
+		return strings.NewReader(files + "\n"), nil
+	}
+	if w.opts.StdinFile != "" {
+		b, err := os.ReadFile(w.opts.StdinFile)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(b), nil
+	}
+	if w.opts.InheritStdin {
+		return os.Stdin, nil
+	}
+	return nil, nil
+}
+
+// commandEnv returns the environment for a command, with the variables
+// in the --env-file, if any, and the ones in env added.
+func (w *Watcher) commandEnv(env map[string]string) []string {
+	vars := os.Environ()
+	// Read on each run, so that changes to it are used right away
+	if w.opts.EnvFile != "" {
+		file, err := readEnvFile(w.opts.EnvFile)
+		if err != nil {
+			errorf("env", Fields{"path": w.opts.EnvFile, "error": err.Error()}, "Unable to read %s: %v", w.opts.EnvFile, err)
+		}
+		vars = append(vars, file...)
+	}
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		vars = append(vars, k+"="+env[k])
+	}
+	return vars
+}
+
+// commandDone records the result of a command run for path, that
+// started at start and returned err, and sends a notification about it
+// if --notify is given.
+func (w *Watcher) commandDone(path string, start time.Time, err error) {
+	w.recordExit(err)
+	w.recordRun(start, err)
+	if !w.opts.Notify {
+		return
+	}
+	title := "whenchange: command succeeded"
+	if err != nil {
+		title = fmt.Sprintf("whenchange: command failed (exit status %d)", ExitCode(err))
+	}
+	body := fmt.Sprintf("Finished in %s", time.Since(start).Round(time.Millisecond))
+	if path != "" {
+		body = fmt.Sprintf("%s changed. %s", path, body)
+	}
+	send := func() {
+		if err := notify(title, body); err != nil {
+			errorf("notify", Fields{"error": err.Error()}, "Unable to send notification: %v", err)
+		}
+	}
+	// With --once, make sure it is sent before exiting
+	if w.opts.Once {
+		send()
+	} else {
+		go send()
+	}
+}
+
+// quoteArgs joins args into a single line, quoting the ones with spaces
+// or quotes so that the arguments can be told apart.
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		if a == "" || strings.ContainsAny(a, " \t\n'\"") {
+			a = strconv.Quote(a)
+		}
+		quoted[i] = a
+	}
+	return strings.Join(quoted, " ")
+}
+
+// ExitCode returns the exit status of a command that returned err.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if e, ok := err.(*exec.ExitError); ok && e.ExitCode() > 0 {
+		return e.ExitCode()
+	}
+	return 1
+}
+
+// commandContext returns the context used to run a command, which
+// expires after --timeout if set.
+func (w *Watcher) commandContext() (context.Context, context.CancelFunc) {
+	if w.opts.Timeout > 0 {
+		return context.WithTimeout(context.Background(), w.opts.Timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// waitCommand waits for c, started with ctx at start, to finish and logs
+// the result, once its output written to term, if any, is copied. It
+// closes waited once c exits.
+func (w *Watcher) waitCommand(ctx context.Context, c *exec.Cmd, start time.Time, waited chan struct{}, term *pseudoTerminal) error {
+	err := c.Wait()
+	w.commandExited()
+	close(waited)
+	outputs := []io.Writer{c.Stdout, c.Stderr}
+	if term != nil {
+		term.Close(w.opts.Grace + killGrace)
+		outputs = append(outputs, term.out)
+	}
+	for _, out := range outputs {
+		if p, ok := out.(*prefixWriter); ok && p.mu != nil {
+			p.Flush()
+		}
+	}
+	elapsed := time.Since(start)
+	if ctx.Err() == context.DeadlineExceeded {
+		errorf("timeout", Fields{"exit_code": ExitCode(err)}, "Command timed out after %s, stopped", w.opts.Timeout)
+		logDone(err, elapsed)
+	} else {
+		logExit(err, elapsed)
+	}
+	return err
+}
+
+// logExit logs the result of a command that returned err after running
+// for elapsed.
+func logExit(err error, elapsed time.Duration) {
+	if err != nil {
+		errorf("exit", Fields{"exit_code": ExitCode(err), "error": err.Error()}, "Error: %s", err)
+	}
+	logDone(err, elapsed)
+}
+
+// logDone logs how long a command that returned err ran, and its exit
+// status.
+func logDone(err error, elapsed time.Duration) {
+	elapsed = elapsed.Round(time.Millisecond)
+	infof("exit", Fields{"exit_code": ExitCode(err), "duration": elapsed.Seconds()},
+		"Done in %s (exit %d)", elapsed, ExitCode(err))
+}
+
+// Type runStatus is the state of the runs of the command, guarded by its
+// mutex, as the commands may finish in the background.
+type runStatus struct {
+	mu sync.Mutex
+	// Start, exit code and duration of the last run
+	start    time.Time
+	exitCode int
+	duration time.Duration
+	// Number of commands running, and the last time one exited
+	running int
+	exited  time.Time
+	// Runs so far, how many failed, and the time spent running
+	runs    int
+	failed  int
+	elapsed time.Duration
+	// Runs that failed in a row, and whether the runs are paused because
+	// of them, with --fail-fast
+	failedInRow int
+	paused      bool
+	// Events received so far, for --metrics-addr
+	events int
+}
+
+// recordRun keeps the result of a command that started at start and
+// returned err, for the status.
+func (w *Watcher) recordRun(start time.Time, err error) {
+	w.status.mu.Lock()
+	defer w.status.mu.Unlock()
+	w.status.start = start
+	w.status.exitCode = ExitCode(err)
+	w.status.runs++
+	if w.status.exitCode != 0 {
+		w.status.failed++
+		w.status.failedInRow++
+	} else {
+		w.status.failedInRow = 0
+	}
+	w.status.duration = time.Since(start)
+	w.status.elapsed += w.status.duration
+	w.checkFailFast()
+}
+
+// logSummary logs the runs of the session, with --summary-on-exit.
+func (w *Watcher) logSummary() {
+	w.status.mu.Lock()
+	defer w.status.mu.Unlock()
+	s := &w.status
+	elapsed := s.elapsed.Round(time.Millisecond)
+	infof("summary", Fields{"runs": s.runs, "succeeded": s.runs - s.failed, "failed": s.failed, "duration": elapsed.Seconds()},
+		"%d runs, %d succeeded, %d failed, %s spent running the command", s.runs, s.runs-s.failed, s.failed, elapsed)
+}
+
+// commandStarted records that a command started running.
+func (w *Watcher) commandStarted() {
+	w.status.mu.Lock()
+	defer w.status.mu.Unlock()
+	w.status.running++
+}
+
+// commandExited records that a command exited.
+func (w *Watcher) commandExited() {
+	w.status.mu.Lock()
+	defer w.status.mu.Unlock()
+	w.status.running--
+	w.status.exited = time.Now()
+}
+
+// duringRun reports whether a command is running, or one exited less
+// than the settle time ago, so that the changes it made are ignored
+// with --ignore-during-run.
+func (w *Watcher) duringRun() bool {
+	w.status.mu.Lock()
+	defer w.status.mu.Unlock()
+	return w.status.running > 0 || time.Since(w.status.exited) < w.opts.Settle
+}
+
+// Type runningCommand is a command started in the background.
+type runningCommand struct {
+	*exec.Cmd
+	// Closed when the command exits
+	done chan struct{}
+	// Set when the command is stopped by a new change. Accessed atomically.
+	stopped int32
+}
+
+// startRunning starts c, run with the variables in env by the rule with
+// index rule, in the background, in its own process group, so that it can
+// be stopped when the next change for the rule arrives. Its output is
+// written to term, if not nil. Must be called with runMu held.
+func (w *Watcher) startRunning(rule int, ctx context.Context, cancel context.CancelFunc, c *exec.Cmd, waited chan struct{}, env map[string]string, term *pseudoTerminal) {
+	path := env["WHENCHANGE_PATH"]
+	setProcessGroup(c)
+	start := time.Now()
+	if err := c.Start(); err != nil {
+		term.Close(0)
+		errorf("exit", Fields{"exit_code": ExitCode(err), "error": err.Error()}, "Error: %s", err)
+		w.commandDone(path, start, err)
+		w.runAfter(env, err)
+		cancel()
+		return
+	}
+	w.commandStarted()
+	r := &runningCommand{Cmd: c, done: make(chan struct{})}
+	w.running[rule] = r
+	go func() {
+		err := w.waitCommand(ctx, c, start, waited, term)
+		// Being replaced by a new run is not a failure
+		if atomic.LoadInt32(&r.stopped) == 0 {
+			w.commandDone(path, start, err)
+			w.runAfter(env, err)
+		}
+		cancel()
+		close(r.done)
+	}()
+}
+
+// stopAll terminates all the commands started by startRunning. Must be
+// called with runMu held.
+func (w *Watcher) stopAll() {
+	for rule := range w.running {
+		w.stopRunning(rule)
+	}
+}
+
+// stopRunning terminates the command started by startRunning for the
+// rule with index rule, if it is still running. Must be called with runMu
+// held.
+func (w *Watcher) stopRunning(rule int) {
+	r, ok := w.running[rule]
+	if !ok {
+		return
+	}
+	delete(w.running, rule)
+	select {
+	case <-r.done:
+		return
+	default:
+	}
+	atomic.StoreInt32(&r.stopped, 1)
+	terminate(r.Cmd, w.opts.Grace, r.done)
+}
+
+// terminate stops c and waits until done is closed. The command, and its
+// process group if it has one, receives SIGTERM first, and SIGKILL if it
+// did not exit after grace.
+func terminate(c *exec.Cmd, grace time.Duration, done <-chan struct{}) {
+	infof("stop", Fields{"pid": c.Process.Pid}, "Stopping command (pid %d) ...", c.Process.Pid)
+	interruptCommand(c)
+	select {
+	case <-done:
+		return
+	case <-time.After(grace):
+	}
+	infof("kill", Fields{"pid": c.Process.Pid}, "Command did not stop after %s, killing it", grace)
+	killCommand(c)
+	<-done
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRunCommandShellArgs(t *testing.T) {
+	captureLog(t)
+	cmd := []string{"true", "a", "b c"}
+	for _, tc := range []struct {
+		name      string
+		shellArgs []string
+		noShell   bool
+		want      []string
+	}{
+		{"default", nil, false, []string{"sh", "-c", "true a b c"}},
+		{"shell args", []string{"-e", "-c"}, false, []string{"sh", "-e", "-c", "true a b c"}},
+		{"no shell", nil, true, []string{"true", "a", "b c"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := recordCommands(t)
+			opts := testOptions()
+			opts.ShellArgs = tc.shellArgs
+			opts.NoShell = tc.noShell
+			w := newTestWatcher(t, opts, NewMemorySource())
+			w.runMu.Lock()
+			err := w.RunCommand(0, cmd, map[string]string{"WHENCHANGE_PATH": "a"})
+			w.runMu.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(r.runs) != 1 || !reflect.DeepEqual(r.runs[0], tc.want) {
+				t.Errorf("Ran %q, expected %q", r.runs, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"time"
+)
+
+// Name of the configuration file looked up in the working directory.
+const defaultConfigFile = ".whenchange.json"
+
+// Name of the file with exclusions looked up in the working directory.
+const defaultIgnoreFile = ".whenchangeignore"
+
+// Type Config holds the options read from a configuration file. Its
+// fields mirror the command line flags; missing fields keep the flag
+// values, and flags given on the command line take precedence.
+type Config struct {
+	Patterns           []string `json:"patterns"`
+	PatternsFrom       string   `json:"patternsFrom"`
+	Files              []string `json:"files"`
+	Exclude            []string `json:"exclude"`
+	Include            []string `json:"include"`
+	Recursive          *bool    `json:"recursive"`
+	FollowSymlinks     *bool    `json:"followSymlinks"`
+	WatchHidden        *bool    `json:"watchHidden"`
+	Gitignore          *bool    `json:"gitignore"`
+	Delay              string   `json:"delay"`
+	MinInterval        string   `json:"minInterval"`
+	Settle             string   `json:"settle"`
+	Jitter             string   `json:"jitter"`
+	Debounce           string   `json:"debounce"`
+	DebouncePerCommand *bool    `json:"debouncePerCommand"`
+	CoalesceSaves      *bool    `json:"coalesceSaves"`
+	CheckMtime         *bool    `json:"checkMtime"`
+	WatchMtimeOnly     *bool    `json:"watchMtimeOnly"`
+	MinSize            string   `json:"minSize"`
+	MaxSize            string   `json:"maxSize"`
+	Poll               string   `json:"poll"`
+	MaxWatches         *int     `json:"maxWatches"`
+	DirWatchOnly       *bool    `json:"dirWatchOnly"`
+	Shell              string   `json:"shell"`
+	NoShell            *bool    `json:"noShell"`
+	ShellArgs          string   `json:"shellArgs"`
+	Restart            *bool    `json:"restart"`
+	IgnoreDuringRun    *bool    `json:"ignoreDuringRun"`
+	Timeout            string   `json:"timeout"`
+	MaxRuntime         string   `json:"maxRuntime"`
+	Grace              string   `json:"grace"`
+	Parallel           *int     `json:"parallel"`
+	Retries            *int     `json:"retries"`
+	RetryDelay         string   `json:"retryDelay"`
+	FailFast           *int     `json:"failFast"`
+	FailFastReset      string   `json:"failFastReset"`
+	Once               *bool    `json:"once"`
+	Notify             *bool    `json:"notify"`
+	DryRun             *bool    `json:"dryRun"`
+	Events             string   `json:"events"`
+	WatchNewOnly       *bool    `json:"watchNewOnly"`
+	Batch              *bool    `json:"batch"`
+	GroupByDir         *bool    `json:"groupByDir"`
+	FilesToStdin       *bool    `json:"filesToStdin"`
+	FilesTmpfile       *bool    `json:"filesTmpfile"`
+	RunOnStart         *bool    `json:"runOnStart"`
+	HTTPAddr           string   `json:"httpAddr"`
+	MetricsAddr        string   `json:"metricsAddr"`
+	Since              string   `json:"since"`
+	Verbose            *bool    `json:"verbose"`
+	Verbosity          *int     `json:"verbosity"`
+	Trace              *bool    `json:"trace"`
+	SummaryOnExit      *bool    `json:"summaryOnExit"`
+	Heartbeat          string   `json:"heartbeat"`
+	LogFormat          string   `json:"logFormat"`
+	LogFile            string   `json:"logFile"`
+	Color              string   `json:"color"`
+	Quiet              *bool    `json:"quiet"`
+	Strict             *bool    `json:"strict"`
+	Command            []string `json:"command"`
+	CommandFile        string   `json:"commandFile"`
+	WatchCommandFile   *bool    `json:"watchCommandFile"`
+	WorkingDir         string   `json:"workingDir"`
+	AbsolutePaths      *bool    `json:"absolutePaths"`
+	PTY                *bool    `json:"pty"`
+	EnvFile            string   `json:"envFile"`
+	StdinFile          string   `json:"stdinFile"`
+	StdinNull          *bool    `json:"stdinNull"`
+	Pre                string   `json:"pre"`
+	Post               string   `json:"post"`
+	OnError            string   `json:"onError"`
+	Prefix             string   `json:"prefix"`
+	StateFile          string   `json:"stateFile"`
+	Rules              []Rule   `json:"rules"`
+	FirstMatch         *bool    `json:"firstMatch"`
+}
+
+// ReadConfig parses the configuration file at path.
+func ReadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	for _, d := range []string{c.Timeout, c.MaxRuntime, c.Grace, c.Poll, c.RetryDelay, c.Heartbeat, c.Jitter} {
+		if d == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(d); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Apply copies the configuration values into the flag variables, unless
+// the flag was given on the command line.
+func (c *Config) Apply() {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	isSet := func(names ...string) bool {
+		for _, n := range names {
+			if set[n] {
+				return true
+			}
+		}
+		return false
+	}
+
+	if c.Patterns != nil && !isSet("patterns", "pattners", "p", "patterns-from") {
+		patternList = c.Patterns
+	}
+	if c.Files != nil && !isSet("files") {
+		fileList = c.Files
+	}
+	if c.PatternsFrom != "" && !isSet("patterns-from") {
+		patternsFrom = c.PatternsFrom
+	}
+	if c.Exclude != nil && !isSet("exclude", "x") {
+		excludeList = c.Exclude
+	}
+	if c.Include != nil && !isSet("include", "i") {
+		includeList = c.Include
+	}
+	if c.Recursive != nil && !isSet("recursive", "r") {
+		recursive = *c.Recursive
+	}
+	if c.FollowSymlinks != nil && !isSet("follow-symlinks") {
+		followSymlinks = *c.FollowSymlinks
+	}
+	if c.WatchHidden != nil && !isSet("watch-hidden") {
+		watchHidden = *c.WatchHidden
+	}
+	if c.Gitignore != nil && !isSet("gitignore") {
+		useGitignore = *c.Gitignore
+	}
+	if c.Delay != "" && !isSet("delay", "d") {
+		delaySpec = c.Delay
+	}
+	if c.MinInterval != "" && !isSet("min-interval") {
+		minIntervalSpec = c.MinInterval
+	}
+	if c.Settle != "" && !isSet("settle") {
+		settleSpec = c.Settle
+	}
+	if c.Jitter != "" && !isSet("jitter") {
+		jitter, _ = time.ParseDuration(c.Jitter)
+	}
+	if c.Debounce != "" && !isSet("debounce") {
+		debounce = c.Debounce
+	}
+	if c.DebouncePerCommand != nil && !isSet("debounce-per-command") {
+		debouncePerCommand = *c.DebouncePerCommand
+	}
+	if c.CheckMtime != nil && !isSet("check-mtime") {
+		checkMtime = *c.CheckMtime
+	}
+	if c.WatchMtimeOnly != nil && !isSet("watch-mtime-only") {
+		watchMtimeOnly = *c.WatchMtimeOnly
+	}
+	if c.MinSize != "" && !isSet("min-size") {
+		minSizeSpec = c.MinSize
+	}
+	if c.MaxSize != "" && !isSet("max-size") {
+		maxSizeSpec = c.MaxSize
+	}
+	if c.CoalesceSaves != nil && !isSet("coalesce-saves") {
+		coalesceSaves = *c.CoalesceSaves
+	}
+	if c.Poll != "" && !isSet("poll") {
+		poll, _ = time.ParseDuration(c.Poll)
+	}
+	if c.MaxWatches != nil && !isSet("max-watches") {
+		maxWatches = *c.MaxWatches
+	}
+	if c.DirWatchOnly != nil && !isSet("dir-watch-only") {
+		dirWatchOnly = *c.DirWatchOnly
+	}
+	if c.WatchCommandFile != nil && !isSet("watch-command-file") {
+		watchCommandFile = *c.WatchCommandFile
+	}
+	if c.WorkingDir != "" && !isSet("working-dir", "C") {
+		workingDir = c.WorkingDir
+	}
+	if c.AbsolutePaths != nil && !isSet("absolute-paths") {
+		absolutePaths = *c.AbsolutePaths
+	}
+	if c.PTY != nil && !isSet("pty") {
+		pty = *c.PTY
+	}
+	if c.Pre != "" && !isSet("pre") {
+		pre = c.Pre
+	}
+	if c.Post != "" && !isSet("post") {
+		post = c.Post
+	}
+	if c.OnError != "" && !isSet("on-error") {
+		onError = c.OnError
+	}
+	if c.EnvFile != "" && !isSet("env-file") {
+		envFile = c.EnvFile
+	}
+	if c.StdinFile != "" && !isSet("stdin-file") {
+		stdinFile = c.StdinFile
+	}
+	if c.StdinNull != nil && !isSet("stdin-null") {
+		stdinNull = *c.StdinNull
+	}
+	if c.Prefix != "" && !isSet("prefix") {
+		prefix = c.Prefix
+	}
+	if c.StateFile != "" && !isSet("state-file") {
+		stateFile = c.StateFile
+	}
+	if c.Shell != "" && !isSet("shell") {
+		shell = c.Shell
+	}
+	if c.ShellArgs != "" && !isSet("shell-args") {
+		shellArgs = c.ShellArgs
+	}
+	if c.NoShell != nil && !isSet("no-shell") {
+		noShell = *c.NoShell
+	}
+	if c.Restart != nil && !isSet("restart", "kill") {
+		restart = *c.Restart
+	}
+	if c.IgnoreDuringRun != nil && !isSet("ignore-during-run") {
+		ignoreDuringRun = *c.IgnoreDuringRun
+	}
+	if c.Timeout != "" && !isSet("timeout") {
+		timeout, _ = time.ParseDuration(c.Timeout)
+	}
+	if c.MaxRuntime != "" && !isSet("max-runtime") {
+		maxRuntime, _ = time.ParseDuration(c.MaxRuntime)
+	}
+	if c.Grace != "" && !isSet("grace") {
+		grace, _ = time.ParseDuration(c.Grace)
+	}
+	if c.Parallel != nil && !isSet("parallel") {
+		parallel = *c.Parallel
+	}
+	if c.Retries != nil && !isSet("retries") {
+		retries = *c.Retries
+	}
+	if c.RetryDelay != "" && !isSet("retry-delay") {
+		retryDelay, _ = time.ParseDuration(c.RetryDelay)
+	}
+	if c.FailFast != nil && !isSet("fail-fast") {
+		failFast = *c.FailFast
+	}
+	if c.FailFastReset != "" && !isSet("fail-fast-reset") {
+		resetFile = c.FailFastReset
+	}
+	if c.Once != nil && !isSet("once") {
+		once = *c.Once
+	}
+	if c.Notify != nil && !isSet("notify") {
+		notifyDone = *c.Notify
+	}
+	if c.DryRun != nil && !isSet("dry-run") {
+		dryRun = *c.DryRun
+	}
+	if c.Events != "" && !isSet("events") {
+		eventSpec = c.Events
+	}
+	if c.WatchNewOnly != nil && !isSet("watch-new-only") {
+		watchNewOnly = *c.WatchNewOnly
+	}
+	if c.Batch != nil && !isSet("batch") {
+		batch = *c.Batch
+	}
+	if c.GroupByDir != nil && !isSet("group-by-dir") {
+		groupByDir = *c.GroupByDir
+	}
+	if c.FilesToStdin != nil && !isSet("files-to-stdin") {
+		filesToStdin = *c.FilesToStdin
+	}
+	if c.FilesTmpfile != nil && !isSet("files-tmpfile") {
+		filesTmpfile = *c.FilesTmpfile
+	}
+	if c.FirstMatch != nil && !isSet("first-match") {
+		firstMatch = *c.FirstMatch
+	}
+	if c.RunOnStart != nil && !isSet("run-on-start") {
+		runOnStart = *c.RunOnStart
+	}
+	if c.HTTPAddr != "" && !isSet("http-addr") {
+		httpAddr = c.HTTPAddr
+	}
+	if c.MetricsAddr != "" && !isSet("metrics-addr") {
+		metricsAddr = c.MetricsAddr
+	}
+	if c.Since != "" && !isSet("since") {
+		since = c.Since
+	}
+	if !isSet("verbose", "v", "vv", "vvv", "verbosity") {
+		if c.Verbose != nil && *c.Verbose {
+			verbose = 1
+		} else if c.Verbose != nil {
+			verbose = 0
+		}
+		if c.Verbosity != nil {
+			verbose = Verbosity(*c.Verbosity)
+		}
+	}
+	if c.Trace != nil && !isSet("trace") {
+		trace = *c.Trace
+	}
+	if c.SummaryOnExit != nil && !isSet("summary-on-exit") {
+		summaryOnExit = *c.SummaryOnExit
+	}
+	if c.Heartbeat != "" && !isSet("heartbeat") {
+		heartbeat, _ = time.ParseDuration(c.Heartbeat)
+	}
+	if c.LogFormat != "" && !isSet("log-format") {
+		logFormat = c.LogFormat
+	}
+	if c.LogFile != "" && !isSet("log-file") {
+		logFile = c.LogFile
+	}
+	if c.Color != "" && !isSet("color") {
+		color = c.Color
+	}
+	if c.Strict != nil && !isSet("strict") {
+		strict = *c.Strict
+	}
+	if c.Quiet != nil && !isSet("quiet", "q") {
+		quiet = *c.Quiet
+	}
+	// Either a command, a command file or rules given on the command
+	// line replace the ones from the file
+	if len(cmd) == 0 && !isSet("command-file", "rule") {
+		if len(c.Command) > 0 {
+			cmd = c.Command
+		}
+		commandFile = c.CommandFile
+		if c.Rules != nil {
+			ruleList = c.Rules
+		}
+	}
+}
+
+// PrintConfig writes opts to w as JSON, with the defaults set, for
+// --print-config, along with the settings used by main rather than by
+// Run, such as --max-runtime and the logging ones, and the configuration
+// file read, if any. Durations are written as text, like "1.5s", rather
+// than in nanoseconds.
+func PrintConfig(w io.Writer, opts Options) error {
+	opts.setDefaults()
+	config := configValue(reflect.ValueOf(opts)).(map[string]interface{})
+	config["MaxRuntime"] = maxRuntime.String()
+	config["LogFormat"] = logFormat
+	config["LogFile"] = logFile
+	config["Color"] = color
+	config["Quiet"] = quiet
+	config["Strict"] = strict
+	config["ConfigFile"] = configPath()
+	b, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// configValue returns v as written by PrintConfig: structs as objects
+// with their exported fields, and durations as text. Interfaces and
+// functions, such as the Source, are skipped.
+func configValue(v reflect.Value) interface{} {
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		return v.Interface().(time.Duration).String()
+	case v.Kind() == reflect.Struct && v.Type() != reflect.TypeOf(time.Time{}):
+		fields := make(map[string]interface{})
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Type().Field(i); f.PkgPath == "" && f.Type.Kind() != reflect.Interface && f.Type.Kind() != reflect.Func {
+				fields[f.Name] = configValue(v.Field(i))
+			}
+		}
+		return fields
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct:
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			items[i] = configValue(v.Index(i))
+		}
+		return items
+	}
+	return v.Interface()
+}
+
+// configPath returns the file given with --config, or the default one in
+// the working directory if present, or an empty string.
+func configPath() string {
+	if configFile != "" {
+		return configFile
+	}
+	if _, err := os.Stat(defaultConfigFile); err != nil {
+		return ""
+	}
+	return defaultConfigFile
+}
+
+// LoadConfig reads the file given with --config, or the default one in
+// the working directory if present, and applies it. Errors are logged,
+// and the flag values are kept, or returned by parseFlags with --strict.
+func LoadConfig() {
+	path := configPath()
+	if path == "" {
+		return
+	}
+	c, err := ReadConfig(path)
+	if err != nil {
+		if strict {
+			configErr = fmt.Errorf("unable to load config %s: %v", path, err)
+			return
+		}
+		errorf("config", Fields{"path": path, "error": err.Error()}, "Unable to load config %s: %v", path, err)
+		return
+	}
+	if verbose > 0 {
+		logger.Log("debug", "config", Fields{"path": path}, "Loaded config from %s", path)
+	}
+	c.Apply()
+}
+
+// Patterns, files and exclusions given on the command line, before the
+// ones from the configuration file and the other sources are added, to
+// start from on ReloadConfig.
+var cliPatterns, cliFiles, cliExcludes []string
+
+// ReloadConfig reads the configuration file again, with the patterns
+// from --patterns-from, unless read from stdin, and the .whenchangeignore
+// file, and returns the options with the new values. Flags given on the
+// command line still take precedence.
+func ReloadConfig() (Options, error) {
+	path := configFile
+	if path == "" {
+		path = defaultConfigFile
+	}
+	var c *Config
+	if _, err := os.Stat(path); err == nil || configFile != "" {
+		if c, err = ReadConfig(path); err != nil {
+			return Options{}, err
+		}
+	}
+	patternList = append([]string(nil), cliPatterns...)
+	fileList = append([]string(nil), cliFiles...)
+	excludeList = append([]string(nil), cliExcludes...)
+	if c != nil {
+		c.Apply()
+	}
+	if patternsFrom != "" && patternsFrom != "-" {
+		patterns, err := readPatternsFrom(patternsFrom)
+		if err != nil {
+			return Options{}, err
+		}
+		patternList = append(patternList, patterns...)
+	}
+	loadIgnoreFile()
+	return options(), nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestPrintConfig(t *testing.T) {
+	oldRuntime, oldFormat, oldFile := maxRuntime, logFormat, configFile
+	defer func() { maxRuntime, logFormat, configFile = oldRuntime, oldFormat, oldFile }()
+	maxRuntime, logFormat, configFile = 90*time.Second, "json", "whenchange.json"
+
+	var b bytes.Buffer
+	if err := PrintConfig(&b, Options{Settle: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &config); err != nil {
+		t.Fatalf("Invalid JSON printed: %v\n%s", err, b.String())
+	}
+	for key, want := range map[string]interface{}{
+		"Settle":     "1s",
+		"Shell":      "bash",
+		"MaxRuntime": "1m30s",
+		"LogFormat":  "json",
+		"ConfigFile": "whenchange.json",
+		"Strict":     false,
+	} {
+		if got := config[key]; got != want {
+			t.Errorf("Printed %s: %v, expected %v", key, got, want)
+		}
+	}
+	for _, key := range []string{"LogFile", "Color", "Quiet"} {
+		if _, ok := config[key]; !ok {
+			t.Errorf("%s not printed", key)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Option given after a pattern to debounce the paths matching it with
+// another delay, as in -p 'assets/*.png:delay=2s'.
+const delayOption = ":delay="
+
+// Type PatternDelay is the delay used for the changes to the paths
+// matching Pattern, instead of --delay.
+type PatternDelay struct {
+	Pattern string
+	Delay   time.Duration
+}
+
+// SplitPatternDelay returns pattern without the delay given after it, if
+// any, and that delay. The delay is nil if not given.
+func SplitPatternDelay(pattern string) (string, *time.Duration, error) {
+	i := strings.LastIndex(pattern, delayOption)
+	if i < 0 {
+		return pattern, nil, nil
+	}
+	d, err := ParseDelay(pattern[i+len(delayOption):])
+	if err != nil {
+		return pattern[:i], nil, err
+	}
+	return pattern[:i], &d, nil
+}
+
+// Units of the delays given as phrases, as in "1 minute 30 seconds".
+var delayUnits = map[string]time.Duration{
+	"ms": time.Millisecond, "millisecond": time.Millisecond, "milliseconds": time.Millisecond,
+	"s": time.Second, "sec": time.Second, "secs": time.Second, "second": time.Second, "seconds": time.Second,
+	"m": time.Minute, "min": time.Minute, "mins": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+	"h": time.Hour, "hour": time.Hour, "hours": time.Hour,
+}
+
+// ParseDelay parses a delay given as a duration, like 1m30s, or as a
+// phrase, like "1 minute 30 seconds", "1 minute and 30 seconds" or
+// "500 ms".
+func ParseDelay(spec string) (time.Duration, error) {
+	if d, err := time.ParseDuration(spec); err == nil {
+		return d, nil
+	}
+	var words []string
+	for _, w := range strings.Fields(strings.ToLower(strings.ReplaceAll(spec, ",", " "))) {
+		if w != "and" {
+			words = append(words, w)
+		}
+	}
+	if len(words) == 0 || len(words)%2 != 0 {
+		return 0, fmt.Errorf("invalid delay %q", spec)
+	}
+	var d time.Duration
+	for i := 0; i < len(words); i += 2 {
+		n, err := strconv.ParseFloat(words[i], 64)
+		unit, ok := delayUnits[words[i+1]]
+		if err != nil || !ok || n < 0 {
+			return 0, fmt.Errorf("invalid delay %q", spec)
+		}
+		d += time.Duration(n * float64(unit))
+	}
+	return d, nil
+}
+
+// delaysFor returns the minimum interval and the settle time for the
+// changes to path: the delay of the first pattern with one that matches
+// path, like the patterns of a Rule do, or the ones given with the flags.
+func (w *Watcher) delaysFor(path string) (time.Duration, time.Duration) {
+	for _, d := range w.opts.Delays {
+		if (Rule{Patterns: []string{d.Pattern}}).Match(path) {
+			return d.Delay, d.Delay
+		}
+	}
+	return w.opts.MinInterval, w.opts.Settle
+}
+
+// jitter returns a random delay, up to --jitter, to wait for before
+// running the command for a change, so that several instances watching
+// the same paths do not all run at once.
+func (w *Watcher) jitter() time.Duration {
+	if w.opts.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(w.opts.Jitter)))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ParseEnv parses the variables in r, given as KEY=VALUE lines, and
+// returns them as KEY=VALUE strings, in order. Blank lines and lines
+// starting with # are skipped, and a leading export is allowed. Values
+// can be quoted: double quotes accept the Go escapes, such as \n, and
+// single quotes are taken literally. Unquoted values end at a # preceded
+// by a space.
+func ParseEnv(r io.Reader) ([]string, error) {
+	var env []string
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		i := strings.Index(line, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", n)
+		}
+		key := strings.TrimSpace(line[:i])
+		value, err := parseEnvValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		env = append(env, key+"="+value)
+	}
+	return env, s.Err()
+}
+
+// parseEnvValue returns the value given in a line of an env file.
+func parseEnvValue(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, `"`):
+		end := closingQuote(v)
+		if end < 0 {
+			return "", fmt.Errorf("missing closing quote")
+		}
+		return strconv.Unquote(v[:end+1])
+	case strings.HasPrefix(v, "'"):
+		end := strings.Index(v[1:], "'")
+		if end < 0 {
+			return "", fmt.Errorf("missing closing quote")
+		}
+		return v[1 : end+1], nil
+	}
+	if i := strings.Index(v, " #"); i >= 0 {
+		v = strings.TrimSpace(v[:i])
+	}
+	return v, nil
+}
+
+// closingQuote returns the index of the double quote closing the string
+// that starts at v[0], skipping the escaped ones, or -1.
+func closingQuote(v string) int {
+	for i := 1; i < len(v); i++ {
+		switch v[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// readEnvFile reads the variables in the file name, as given with
+// --env-file.
+func readEnvFile(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseEnv(f)
+}
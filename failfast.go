@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// checkFailFast pauses the runs once the command failed --fail-fast times
+// in a row, until resumed. Must be called with status.mu held.
+func (w *Watcher) checkFailFast() {
+	s := &w.status
+	if w.opts.FailFast <= 0 || s.paused || s.failedInRow < w.opts.FailFast {
+		return
+	}
+	s.paused = true
+	warnf("pause", Fields{"failed": s.failedInRow}, "Command failed %d times in a row, paused until %s", s.failedInRow, w.resumeHint())
+}
+
+// resumeHint describes how to resume the runs paused by --fail-fast.
+func (w *Watcher) resumeHint() string {
+	var ways []string
+	if w.opts.ResetFile != "" {
+		ways = append(ways, fmt.Sprintf("%s changes", w.opts.ResetFile))
+	}
+	if resumeSignal != nil {
+		ways = append(ways, "SIGUSR1 is received")
+	}
+	if len(ways) == 0 {
+		return "restarted"
+	}
+	return strings.Join(ways, " or ")
+}
+
+// isPaused reports whether the runs are paused by --fail-fast.
+func (w *Watcher) isPaused() bool {
+	w.status.mu.Lock()
+	defer w.status.mu.Unlock()
+	return w.status.paused
+}
+
+// Resume runs the command again on changes, if paused by --fail-fast,
+// logging why.
+func (w *Watcher) Resume(reason string) {
+	w.status.mu.Lock()
+	defer w.status.mu.Unlock()
+	if !w.status.paused {
+		return
+	}
+	w.status.paused = false
+	w.status.failedInRow = 0
+	infof("resume", nil, "%s, resuming runs", reason)
+}
+
+// watchResetFile watches the directory of the --fail-fast-reset file, so
+// that the file is seen when changed, or created, without it being in the
+// watch list.
+func (w *Watcher) watchResetFile() {
+	dir := filepath.Dir(w.opts.ResetFile)
+	if err := w.source.Watch(dir); err != nil {
+		warnf("watch", Fields{"path": dir, "error": err.Error()}, "Unable to watch %s for %s: %v", dir, w.opts.ResetFile, err)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Type dirKey identifies a directory, no matter the path it is reached
+// from, by its device and inode numbers.
+type dirKey struct {
+	dev, ino uint64
+}
+
+// dirKeyOf returns the dirKey of the directory at path, with info.
+func dirKeyOf(path string, info os.FileInfo) dirKey {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return dirKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+	}
+	return dirKey{}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Type dirKey identifies a directory, no matter the path it is reached
+// from, by its absolute path with all links resolved.
+type dirKey string
+
+// dirKeyOf returns the dirKey of the directory at path, with info.
+func dirKeyOf(path string, info os.FileInfo) dirKey {
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+	abs, _ := filepath.Abs(path)
+	return dirKey(abs)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+)
+
+// newFileList creates the temporary file given to the command with
+// --files-tmpfile, for the list of changed files, and returns its path.
+func newFileList() (string, error) {
+	f, err := os.CreateTemp("", "whenchange-files-*.txt")
+	if err != nil {
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// writeFileList writes the changed files in env, one per line, to the
+// file list in WHENCHANGE_FILELIST, if any. It is written again before
+// each run of the command, as it is removed after each one, and retries
+// run again with the same list.
+func writeFileList(env map[string]string) error {
+	name := env["WHENCHANGE_FILELIST"]
+	if name == "" {
+		return nil
+	}
+	return os.WriteFile(name, []byte(env["WHENCHANGE_FILES"]+"\n"), 0600)
+}
+
+// removeFileList removes the file list in WHENCHANGE_FILELIST, if any,
+// once the command and its hooks are done with it.
+func removeFileList(env map[string]string) {
+	if name := env["WHENCHANGE_FILELIST"]; name != "" {
+		os.Remove(name)
+	}
+}
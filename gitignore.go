@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Type IgnoreRule is a single pattern line parsed from a .gitignore file.
+type IgnoreRule struct {
+	// Directory holding the .gitignore file, as an absolute path
+	Base string
+	// Glob pattern, without the leading '!' or '/' and the trailing '/'
+	Pattern string
+	// Pattern started with '!' and re-includes a previous match
+	Negate bool
+	// Pattern ended with '/' and only matches directories
+	DirOnly bool
+	// Pattern contained a '/' and is relative to Base
+	Anchored bool
+}
+
+// Type IgnoreRules is an ordered list of .gitignore rules. Later rules
+// take precedence over earlier ones, like in git itself.
+type IgnoreRules []IgnoreRule
+
+// ParseGitignore reads the .gitignore file in dir, if any.
+func ParseGitignore(dir string) (IgnoreRules, error) {
+	base, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(base, ".gitignore"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules IgnoreRules
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r := IgnoreRule{Base: base}
+		if strings.HasPrefix(line, "!") {
+			r.Negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.DirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		// A leading "**/" matches in all directories, same as no slash
+		line = strings.TrimPrefix(line, "**/")
+		if strings.Contains(line, "/") {
+			r.Anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		r.Pattern = line
+		rules = append(rules, r)
+	}
+	return rules, s.Err()
+}
+
+// Match reports whether path is ignored by the rules. The path's parent
+// directories are also checked, since git never descends into an ignored
+// directory.
+func (rules IgnoreRules) Match(path string, isDir bool) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	if parent := filepath.Dir(abs); parent != abs && rules.Match(parent, true) {
+		return true
+	}
+	ignored := false
+	for _, r := range rules {
+		if r.DirOnly && !isDir {
+			continue
+		}
+		rel, err := filepath.Rel(r.Base, abs)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		name := filepath.Base(rel)
+		if r.Anchored {
+			name = filepath.ToSlash(rel)
+		}
+		if ok, _ := filepath.Match(r.Pattern, name); ok {
+			ignored = !r.Negate
+		}
+	}
+	return ignored
+}
+
+// LoadGitignore parses the .gitignore in dir, if not loaded yet, and
+// layers its rules on top of the ones already in use.
+func (w *Watcher) LoadGitignore(dir string) {
+	abs, err := filepath.Abs(dir)
+	if err != nil || w.gitignoreLoaded[abs] {
+		return
+	}
+	w.gitignoreLoaded[abs] = true
+	rules, err := ParseGitignore(abs)
+	if err != nil {
+		errorf("gitignore", Fields{"path": abs, "error": err.Error()}, "Unable to load .gitignore from %s: %v", abs, err)
+		return
+	}
+	if len(rules) > 0 {
+		w.verbosef(1, "Loaded %d rules from %s", len(rules), filepath.Join(abs, ".gitignore"))
+		w.gitignoreRules = append(w.gitignoreRules, rules...)
+	}
+}
+
+// LoadParentGitignores loads the .gitignore files from dir up to the
+// root of the git repository that contains it, parents first. If dir is
+// not inside a git repository, only its own .gitignore is loaded.
+func (w *Watcher) LoadParentGitignores(dir string) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return
+	}
+	dirs := []string{abs}
+	for {
+		if _, err := os.Stat(filepath.Join(abs, ".git")); err == nil {
+			break
+		}
+		parent := filepath.Dir(abs)
+		if parent == abs {
+			// Not a git repository
+			dirs = dirs[:1]
+			break
+		}
+		abs = parent
+		dirs = append(dirs, abs)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		w.LoadGitignore(dirs[i])
+	}
+}
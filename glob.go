@@ -0,0 +1,184 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Pattern segment that matches any number of directories.
+const globstar = "**"
+
+// hasGlobstar reports whether pattern has a ** segment.
+func hasGlobstar(pattern string) bool {
+	for _, s := range strings.Split(filepath.ToSlash(pattern), "/") {
+		if s == globstar {
+			return true
+		}
+	}
+	return false
+}
+
+// Glob returns the paths matching pattern, like filepath.Glob, but a **
+// segment in the pattern also matches any number of directories, so that
+// 'src/**/*.go' matches the go files at any depth below src. The tree is
+// walked to find the matches, without following links.
+func Glob(pattern string) ([]string, error) {
+	if !hasGlobstar(pattern) {
+		return filepath.Glob(pattern)
+	}
+	// Check the pattern syntax, as filepath.Glob does
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	pattern = normalizePath(pattern)
+	root := filepath.VolumeName(pattern)
+	rest := pattern[len(root):]
+	if strings.HasPrefix(rest, string(filepath.Separator)) {
+		root += string(filepath.Separator)
+		rest = rest[1:]
+	} else if root == "" {
+		root = "."
+	}
+	seen := make(map[string]bool)
+	var matches []string
+	var walk func(dir string, segs []string)
+	walk = func(dir string, segs []string) {
+		if len(segs) == 0 {
+			if !seen[dir] {
+				seen[dir] = true
+				matches = append(matches, dir)
+			}
+			return
+		}
+		seg := segs[0]
+		if seg == globstar {
+			// Match no directories, or one more and keep the **
+			walk(dir, segs[1:])
+			entries, _ := os.ReadDir(dir)
+			for _, e := range entries {
+				if e.IsDir() {
+					walk(filepath.Join(dir, e.Name()), segs)
+				}
+			}
+			return
+		}
+		if !hasMeta(seg) {
+			if p := filepath.Join(dir, seg); exists(p) {
+				walk(p, segs[1:])
+			}
+			return
+		}
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			if ok, _ := filepath.Match(seg, e.Name()); ok {
+				walk(filepath.Join(dir, e.Name()), segs[1:])
+			}
+		}
+	}
+	walk(root, strings.Split(rest, string(filepath.Separator)))
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// MatchGlob reports whether name matches pattern, like filepath.Match,
+// but a ** segment in the pattern also matches any number of directories.
+func MatchGlob(pattern, name string) (bool, error) {
+	if !hasGlobstar(pattern) {
+		return filepath.Match(pattern, name)
+	}
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return false, err
+	}
+	sep := string(filepath.Separator)
+	return matchSegments(strings.Split(normalizePath(pattern), sep), strings.Split(normalizePath(name), sep)), nil
+}
+
+// matchSegments reports whether the path segments in name match the ones
+// in pattern.
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == globstar {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := filepath.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// hasMeta reports whether path has any of the special characters of
+// filepath.Match.
+func hasMeta(path string) bool {
+	magic := `*?[`
+	if runtime.GOOS != "windows" {
+		magic = `*?[\`
+	}
+	return strings.ContainsAny(path, magic)
+}
+
+// exists reports whether path exists, without following links.
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// isHidden reports whether the base name of path starts with a dot, as
+// for .git or .idea.
+func isHidden(path string) bool {
+	base := filepath.Base(path)
+	return strings.HasPrefix(base, ".") && base != "." && base != ".."
+}
+
+// hiddenMatch reports whether name, matched by pattern, is hidden, or is
+// inside a hidden directory, only because a wildcard matched it. Patterns
+// with a segment starting with a dot, as '.*' or 'src/.config/*.json',
+// ask for hidden paths, and match them.
+func hiddenMatch(pattern, name string) bool {
+	dotted := false
+	for _, s := range strings.Split(normalizePath(pattern), string(filepath.Separator)) {
+		if isHidden(s) {
+			dotted = true
+			break
+		}
+	}
+	if dotted {
+		return false
+	}
+	for _, s := range strings.Split(normalizePath(name), string(filepath.Separator)) {
+		if isHidden(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// patternDir returns the directory the paths matching pattern would be
+// created in: the part of it before the first segment with wildcards, or
+// its parent if it has none, or the closest of their parents that exists.
+func patternDir(pattern string) string {
+	dir := filepath.Dir(normalizePath(pattern))
+	for hasMeta(dir) {
+		dir = filepath.Dir(dir)
+	}
+	// Missing directories are expected here, and not logged like IsDir does
+	for dir != filepath.Dir(dir) {
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	return dir
+}
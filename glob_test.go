@@ -0,0 +1,18 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPatternDirMissing(t *testing.T) {
+	logs := captureLog(t)
+	dir := t.TempDir()
+	if got := patternDir(filepath.Join(dir, "build", "out", "*.log")); got != dir {
+		t.Errorf("patternDir() = %s, expected %s", got, dir)
+	}
+	if strings.Contains(logs.String(), "Unable to stat") {
+		t.Errorf("Missing directories logged:\n%s", logs)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// runHook runs the --pre or --post hook command given, named name, with
+// the shell, and with the variables in env added to the environment. The
+// placeholders in it are expanded like in the command. Hooks that are
+// not given are not run.
+func (w *Watcher) runHook(name, hook string, env map[string]string) error {
+	if hook == "" {
+		return nil
+	}
+	hook, err := NewChange(env["WHENCHANGE_PATH"]).Expand(hook)
+	if err != nil {
+		errorf(name, Fields{"error": err.Error()}, "Invalid %s hook template: %v", name, err)
+		return err
+	}
+	infof(name, Fields{"command": hook}, "Running %s hook '%s' ...", name, hook)
+	c := exec.Command(w.opts.Shell, w.shellLine(hook)...)
+	c.Dir = w.opts.WorkingDir
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	c.Env = w.commandEnv(env)
+	if err := c.Run(); err != nil {
+		errorf(name, Fields{"exit_code": ExitCode(err), "error": err.Error()}, "The %s hook failed: %v", name, err)
+		return err
+	}
+	return nil
+}
+
+// runAfter runs the hooks for a command that returned err: the --on-error
+// one if it failed, and then the --post one, with its exit code in
+// WHENCHANGE_EXIT_CODE. The --files-tmpfile list is removed after them.
+func (w *Watcher) runAfter(env map[string]string, err error) {
+	defer removeFileList(env)
+	code := ExitCode(err)
+	if w.opts.Post == "" && (w.opts.OnError == "" || code == 0) {
+		return
+	}
+	env = withVars(env, "WHENCHANGE_EXIT_CODE", strconv.Itoa(code))
+	if code != 0 {
+		w.runHook("on-error", w.opts.OnError, env)
+	}
+	w.runHook("post", w.opts.Post, env)
+}
+
+// withVars returns a copy of env with the given pairs of names and
+// values added.
+func withVars(env map[string]string, vars ...string) map[string]string {
+	c := make(map[string]string, len(env)+len(vars)/2)
+	for k, v := range env {
+		c[k] = v
+	}
+	for i := 0; i+1 < len(vars); i += 2 {
+		c[vars[i]] = vars[i+1]
+	}
+	return c
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Type Status is the state of whenchange reported by GET /status with
+// --http-addr.
+type Status struct {
+	// Time the last run of the command started, if any
+	LastRun *time.Time `json:"lastRun"`
+	// Exit code of the last run of the command, if any
+	LastExitCode *int `json:"lastExitCode"`
+	// Number of paths watched
+	WatchedPaths int `json:"watchedPaths"`
+}
+
+// Status returns the current state of the watcher.
+func (w *Watcher) Status() Status {
+	s := Status{WatchedPaths: w.watchCount()}
+	w.status.mu.Lock()
+	defer w.status.mu.Unlock()
+	if !w.status.start.IsZero() {
+		start, code := w.status.start, w.status.exitCode
+		s.LastRun, s.LastExitCode = &start, &code
+	}
+	return s
+}
+
+// StartHTTP starts the server for --http-addr, listening on addr, and
+// returns it so that it can be closed. GET /status reports the Status as
+// JSON, and POST /trigger runs the command, as if a change happened.
+func (w *Watcher) StartHTTP(addr string) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(rw, "use GET", http.StatusMethodNotAllowed)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(w.Status())
+	})
+	mux.HandleFunc("/trigger", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(rw, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		// A run already waiting covers this one as well
+		select {
+		case w.trigger <- struct{}{}:
+		default:
+		}
+		rw.WriteHeader(http.StatusAccepted)
+	})
+	return serve("http", addr, mux)
+}
+
+// serve serves the endpoints in mux on addr, in the background, and
+// returns the server so that it can be closed. The errors are logged as
+// event.
+func serve(event, addr string, mux *http.ServeMux) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			errorf(event, Fields{"error": err.Error()}, "HTTP server stopped: %v", err)
+		}
+	}()
+	infof(event, Fields{"addr": ln.Addr().String()}, "Listening on http://%s", ln.Addr())
+	return srv, nil
+}
+
+// Trigger runs the command once, when asked with POST /trigger. There is
+// no changed path, so WHENCHANGE_PATH and the placeholders are empty.
+func (w *Watcher) Trigger() (bool, error) {
+	w.runMu.Lock()
+	defer w.runMu.Unlock()
+	return w.execute("", "trigger", nil)
+}
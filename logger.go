@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Type Fields holds the structured details of a log entry, such as the
+// path that changed or the exit code of the command.
+type Fields map[string]interface{}
+
+// Type Logger writes the messages from whenchange, either as text lines
+// using the log package, or as JSON objects, one per line. The output of
+// the command itself is never written through it.
+type Logger struct {
+	// Write JSON objects instead of text
+	JSON bool
+	// Skip informational messages, and only write warnings and errors
+	Quiet bool
+	// Color the text messages by level, and the exit of the command by
+	// its result
+	Color bool
+	mu    sync.Mutex
+	out   io.Writer
+}
+
+// Logger used for all messages, writing text to stderr by default.
+var logger = &Logger{out: os.Stderr}
+
+// SetFormat selects the output format, either "text" or "json".
+func (l *Logger) SetFormat(format string) error {
+	switch format {
+	case "text":
+		l.JSON = false
+	case "json":
+		l.JSON = true
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	return nil
+}
+
+// SetOutput writes the messages to the file name, appended to it, or to
+// stderr if name is -. The output of the command is not redirected.
+func (l *Logger) SetOutput(name string) error {
+	out := os.Stderr
+	if name != "-" {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		out = f
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out = out
+	log.SetOutput(out)
+	return nil
+}
+
+// SetColor selects whether text messages are colored: "always", "never",
+// or "auto" to color them when written to a terminal, unless the NO_COLOR
+// environment variable is set.
+func (l *Logger) SetColor(mode string) error {
+	switch mode {
+	case "always":
+		l.Color = true
+	case "never":
+		l.Color = false
+	case "auto":
+		f, ok := l.out.(*os.File)
+		l.Color = ok && isTerminal(f) && os.Getenv("NO_COLOR") == "" && os.Getenv("TERM") != "dumb"
+	default:
+		return fmt.Errorf("unknown color mode %q", mode)
+	}
+	return nil
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// ANSI escape sequences used to color the text messages.
+const (
+	colorReset  = "\x1b[0m"
+	colorDim    = "\x1b[2m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+)
+
+// colorFor returns the color of a text message: red for errors, and for
+// the exit of a failed command, green for the exit of a successful one,
+// yellow for warnings, and dim for the other messages.
+func colorFor(level, event string, fields Fields) string {
+	switch level {
+	case "error", "fatal":
+		return colorRed
+	case "warn":
+		return colorYellow
+	}
+	if event == "exit" {
+		if code, ok := fields["exit_code"].(int); ok && code != 0 {
+			return colorRed
+		}
+		return colorGreen
+	}
+	return colorDim
+}
+
+// Log writes an entry with the message given by format and args. In JSON
+// mode, the entry also has the time, level, event name and fields.
+func (l *Logger) Log(level, event string, fields Fields, format string, args ...interface{}) {
+	if l.Quiet && (level == "info" || level == "debug") {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if !l.JSON {
+		if l.Color {
+			msg = colorFor(level, event, fields) + msg + colorReset
+		}
+		log.Print(msg)
+		return
+	}
+	entry := map[string]interface{}{
+		"time":    time.Now().Format(time.RFC3339Nano),
+		"level":   level,
+		"message": msg,
+	}
+	if event != "" {
+		entry["event"] = event
+	}
+	for k, v := range fields {
+		entry[k] = v
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		b, _ = json.Marshal(map[string]string{"level": "error", "message": err.Error()})
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(b, '\n'))
+}
+
+// infof logs an informational message about event.
+func infof(event string, fields Fields, format string, args ...interface{}) {
+	logger.Log("info", event, fields, format, args...)
+}
+
+// warnf logs a warning about event.
+func warnf(event string, fields Fields, format string, args ...interface{}) {
+	logger.Log("warn", event, fields, format, args...)
+}
+
+// errorf logs an error message about event.
+func errorf(event string, fields Fields, format string, args ...interface{}) {
+	logger.Log("error", event, fields, format, args...)
+}
+
+// fatalf logs an error message and exits with status 1.
+func fatalf(format string, args ...interface{}) {
+	logger.Log("fatal", "", nil, format, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// StartMetrics starts the server for --metrics-addr, listening on addr,
+// and returns it so that it can be closed. GET /metrics reports the
+// metrics in the Prometheus text exposition format.
+func (w *Watcher) StartMetrics(addr string) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(rw, "use GET", http.StatusMethodNotAllowed)
+			return
+		}
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.writeMetrics(rw)
+	})
+	return serve("metrics", addr, mux)
+}
+
+// writeMetrics writes the current metrics to rw. The number of watched
+// paths is counted when asked for, like for GET /status.
+func (w *Watcher) writeMetrics(rw http.ResponseWriter) {
+	watched := w.watchCount()
+	w.status.mu.Lock()
+	events, runs, failed, duration := w.status.events, w.status.runs, w.status.failed, w.status.duration
+	w.status.mu.Unlock()
+	metric := func(name, kind, help string, value interface{}) {
+		fmt.Fprintf(rw, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+	metric("whenchange_watched_paths", "gauge", "Number of paths watched.", watched)
+	metric("whenchange_events_total", "counter", "Number of file system events received.", events)
+	metric("whenchange_runs_total", "counter", "Number of runs of the command.", runs)
+	metric("whenchange_run_failures_total", "counter", "Number of runs of the command that failed.", failed)
+	metric("whenchange_last_run_duration_seconds", "gauge", "Duration of the last run of the command.", duration.Seconds())
+}
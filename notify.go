@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// notify sends a desktop notification with title and body, using the
+// notification tool of the operating system.
+func notify(title, body string) error {
+	var c *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		script := fmt.Sprintf("display notification %s with title %s", appleScriptQuote(body), appleScriptQuote(title))
+		c = exec.Command("osascript", "-e", script)
+	case "windows":
+		script := fmt.Sprintf(`Add-Type -AssemblyName System.Windows.Forms
+$n = New-Object System.Windows.Forms.NotifyIcon
+$n.Icon = [System.Drawing.SystemIcons]::Information
+$n.Visible = $true
+$n.ShowBalloonTip(5000, %s, %s, 'None')
+Start-Sleep -Seconds 5
+$n.Dispose()`, powerShellQuote(title), powerShellQuote(body))
+		c = exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+	default:
+		c = exec.Command("notify-send", title, body)
+	}
+	out, err := c.CombinedOutput()
+	if msg := strings.TrimSpace(string(out)); err != nil && msg != "" {
+		return fmt.Errorf("%v: %s", err, msg)
+	}
+	return err
+}
+
+// appleScriptQuote returns s as an AppleScript string literal.
+func appleScriptQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+// powerShellQuote returns s as a PowerShell single-quoted string literal.
+func powerShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Type fileState is the part of the state of a path the Poller compares
+// to tell whether it changed.
+type fileState struct {
+	ModTime time.Time
+	Size    int64
+	Mode    os.FileMode
+}
+
+// Type Poller is the EventSource that stats the watched paths at an
+// interval, and delivers the differences as changes. It is used with
+// --poll, on file systems where fsnotify does not deliver events, such
+// as network mounts or some container volumes.
+type Poller struct {
+	interval time.Duration
+	// Watched paths, and the last known state of them and of the
+	// entries of the watched directories. Guarded by mu.
+	paths  map[string]bool
+	state  map[string]fileState
+	mu     sync.Mutex
+	events chan Event
+	done   chan struct{}
+}
+
+// NewPoller returns a new Poller, checking for changes every interval.
+func NewPoller(interval time.Duration) *Poller {
+	p := &Poller{
+		interval: interval,
+		paths:    make(map[string]bool),
+		state:    make(map[string]fileState),
+		events:   make(chan Event),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Method Watch implements the EventSource interface.
+func (p *Poller) Watch(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Keyed like Unwatch, whatever the form of path given
+	p.paths[normalizePath(path)] = true
+	for name, st := range scan(path) {
+		p.state[name] = st
+	}
+	return nil
+}
+
+// Method Unwatch implements the EventSource interface.
+func (p *Poller) Unwatch(path string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.paths, normalizePath(path))
+	return nil
+}
+
+// Method Events implements the EventSource interface.
+func (p *Poller) Events() <-chan Event {
+	return p.events
+}
+
+// Method Errors implements the EventSource interface. No errors are
+// delivered: paths that can't be read are reported as deleted.
+func (p *Poller) Errors() <-chan error {
+	return nil
+}
+
+// Method Close implements the EventSource interface.
+func (p *Poller) Close() error {
+	close(p.done)
+	return nil
+}
+
+// run polls the watched paths until the Poller is closed.
+func (p *Poller) run() {
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-t.C:
+			p.poll()
+		}
+	}
+}
+
+// poll compares the current state of the watched paths with the last
+// known one, and delivers the changes.
+func (p *Poller) poll() {
+	p.mu.Lock()
+	current := make(map[string]fileState)
+	for path := range p.paths {
+		for name, st := range scan(path) {
+			current[name] = st
+		}
+	}
+	var events []Event
+	for name, st := range current {
+		old, ok := p.state[name]
+		switch {
+		case !ok:
+			events = append(events, Event{Name: name, Op: "create", Raw: "polled, new path"})
+		case st.Mode != old.Mode:
+			events = append(events, Event{Name: name, Op: "attrib", Raw: fmt.Sprintf("polled, mode %s -> %s", old.Mode, st.Mode)})
+		case !st.Mode.IsDir() && (!st.ModTime.Equal(old.ModTime) || st.Size != old.Size):
+			// Directories change when their entries do, which are
+			// reported by themselves
+			events = append(events, Event{Name: name, Op: "write", Raw: fmt.Sprintf("polled, size %d -> %d, mtime %s -> %s", old.Size, st.Size, old.ModTime, st.ModTime)})
+		}
+	}
+	for name := range p.state {
+		if _, ok := current[name]; !ok {
+			events = append(events, Event{Name: name, Op: "delete", Raw: "polled, path gone"})
+		}
+	}
+	p.state = current
+	p.mu.Unlock()
+
+	sort.Slice(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+	for _, ev := range events {
+		select {
+		case p.events <- ev:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// scan returns the state of path and, if it is a directory, of its
+// entries. Paths that can't be read are left out.
+func scan(path string) map[string]fileState {
+	states := make(map[string]fileState)
+	info, err := os.Stat(path)
+	if err != nil {
+		return states
+	}
+	states[normalizePath(path)] = fileState{ModTime: info.ModTime(), Size: info.Size(), Mode: info.Mode()}
+	if !info.IsDir() {
+		return states
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return states
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		name := filepath.Join(path, e.Name())
+		states[name] = fileState{ModTime: info.ModTime(), Size: info.Size(), Mode: info.Mode()}
+	}
+	return states
+}
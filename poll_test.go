@@ -0,0 +1,25 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPollerUnwatch(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.txt"))
+	p := NewPoller(testTimeout)
+	defer p.Close()
+
+	if err := p.Watch(dir + "/./"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Unwatch(dir); err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.paths) != 0 {
+		t.Errorf("Still polling %v after unwatching %s", p.paths, dir)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Type prefixWriter writes to w, adding prefix at the start of each line,
+// so that the output of the command can be told apart.
+type prefixWriter struct {
+	w      io.Writer
+	prefix []byte
+	// Set when the last write did not end a line
+	midLine bool
+	// When set, only whole lines are written, holding mu, so that the
+	// output of commands running at the same time is not mixed up
+	// within a line. The rest is kept in buf until Flush.
+	mu  *sync.Mutex
+	buf []byte
+}
+
+// Method Write implements the io.Writer interface.
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	if p.mu != nil {
+		p.buf = append(p.buf, b...)
+		i := bytes.LastIndexByte(p.buf, '\n')
+		if i < 0 {
+			return n, nil
+		}
+		b = p.buf[:i+1]
+		p.buf = append([]byte(nil), p.buf[i+1:]...)
+	}
+	var out []byte
+	for len(b) > 0 {
+		if !p.midLine {
+			out = append(out, p.prefix...)
+			p.midLine = true
+		}
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			out = append(out, b...)
+			break
+		}
+		out = append(out, b[:i+1]...)
+		b = b[i+1:]
+		p.midLine = false
+	}
+	if p.mu != nil {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+	}
+	if _, err := p.w.Write(out); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Flush writes the last line kept by a line-buffered writer, if it was
+// not ended, adding a new line.
+func (p *prefixWriter) Flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+	b := append(p.buf, '\n')
+	p.buf = nil
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := p.w.Write(append(append([]byte(nil), p.prefix...), b...))
+	return err
+}
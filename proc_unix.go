@@ -0,0 +1,39 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Signal that resumes the runs paused by --fail-fast.
+var resumeSignal os.Signal = syscall.SIGUSR1
+
+// Signal that reloads the configuration file.
+var reloadSignal os.Signal = syscall.SIGHUP
+
+// setProcessGroup makes c run in its own process group, so that
+// the whole child tree can be signaled at once.
+func setProcessGroup(c *exec.Cmd) {
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalCommand sends sig to c, or to its process group if it has one.
+func signalCommand(c *exec.Cmd, sig syscall.Signal) error {
+	if c.SysProcAttr != nil && c.SysProcAttr.Setpgid {
+		return syscall.Kill(-c.Process.Pid, sig)
+	}
+	return c.Process.Signal(sig)
+}
+
+// interruptCommand asks c to terminate.
+func interruptCommand(c *exec.Cmd) error {
+	return signalCommand(c, syscall.SIGTERM)
+}
+
+// killCommand forcibly kills c.
+func killCommand(c *exec.Cmd) error {
+	return signalCommand(c, syscall.SIGKILL)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Signal that resumes the runs paused by --fail-fast. Windows has no
+// SIGUSR1, so only the --fail-fast-reset file resumes them.
+var resumeSignal os.Signal
+
+// Signal that reloads the configuration file. Windows has no SIGHUP, so
+// it is not reloaded.
+var reloadSignal os.Signal
+
+// setProcessGroup makes c run in its own process group.
+func setProcessGroup(c *exec.Cmd) {
+	c.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// interruptCommand terminates c. Windows has no SIGTERM, so this is
+// the same as killCommand.
+func interruptCommand(c *exec.Cmd) error {
+	return c.Process.Kill()
+}
+
+// killCommand forcibly kills c.
+func killCommand(c *exec.Cmd) error {
+	return c.Process.Kill()
+}
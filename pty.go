@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// Type pseudoTerminal is the pseudo-terminal the command writes its
+// output to with --pty, so that it behaves as if run interactively, with
+// colors and progress bars. The output is copied to the writer the
+// command would have written it to otherwise.
+type pseudoTerminal struct {
+	master, slave *os.File
+	out           io.Writer
+	// Closed once the output is copied
+	copied chan struct{}
+}
+
+// attachPTY makes c write its output, both stdout and stderr, to a new
+// pseudo-terminal, with --pty. If it can't be allocated, c is left as it
+// is, and runs without one.
+func (w *Watcher) attachPTY(c *exec.Cmd) *pseudoTerminal {
+	if !w.opts.PTY {
+		return nil
+	}
+	master, slave, err := openPTY()
+	if err != nil {
+		warnf("pty", Fields{"error": err.Error()}, "Unable to allocate a pseudo-terminal: %v. Running the command without one", err)
+		return nil
+	}
+	t := &pseudoTerminal{master: master, slave: slave, out: c.Stdout, copied: make(chan struct{})}
+	c.Stdout, c.Stderr = slave, slave
+	go func() {
+		// Fails once the command exited and the slave is closed
+		io.Copy(t.out, master)
+		close(t.copied)
+	}()
+	return t
+}
+
+// Close releases the pseudo-terminal once the command exited, or failed
+// to start, after its output is copied. Children of the command left
+// behind with the terminal open are not waited for longer than grace.
+func (t *pseudoTerminal) Close(grace time.Duration) {
+	if t == nil {
+		return
+	}
+	t.slave.Close()
+	select {
+	case <-t.copied:
+	case <-time.After(grace):
+	}
+	t.master.Close()
+}
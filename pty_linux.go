@@ -0,0 +1,56 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// openPTY allocates a new pseudo-terminal, with the size of the one
+// whenchange runs in, if any, and returns its master and slave sides.
+func openPTY() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var n uint32
+	unlock := int32(0)
+	// Fd would make reads on the master blocking, so that closing it does
+	// not stop them
+	conn, err := master.SyscallConn()
+	if err == nil {
+		conn.Control(func(fd uintptr) {
+			if err = ioctl(fd, syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+				return
+			}
+			if err = ioctl(fd, syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+				return
+			}
+			var size [4]uint16
+			if ioctl(os.Stdout.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&size))) == nil {
+				ioctl(fd, syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&size)))
+			}
+		})
+	}
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+// ioctl runs the ioctl request req on fd, with the argument arg.
+func ioctl(fd, req, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// openPTY allocates a new pseudo-terminal. Only supported on Linux.
+func openPTY() (master, slave *os.File, err error) {
+	return nil, nil, errors.New("pseudo-terminals are only supported on Linux")
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sort"
+)
+
+// Reload reads the options again with opts.Reload, on SIGHUP, and watches
+// the paths of the new patterns, files and exclusions instead of the
+// current ones. The paths no longer matched are not watched anymore, and
+// the others keep the time they last triggered the command. The other
+// options, and the rules, are kept until restarted.
+func (w *Watcher) Reload() {
+	if w.opts.Reload == nil {
+		return
+	}
+	opts, err := w.opts.Reload()
+	if err != nil {
+		errorf("reload", Fields{"error": err.Error()}, "Unable to reload the configuration: %v. Keeping the current one", err)
+		return
+	}
+	addedExcludes, removedExcludes := diffLists(w.opts.Exclude, opts.Exclude)
+	w.opts.Exclude = opts.Exclude
+	patterns := append([]string(nil), opts.Patterns...)
+	for _, r := range w.opts.Rules {
+		patterns = append(patterns, r.Patterns...)
+	}
+	if w.opts.Recursive {
+		patterns = w.SubsumePatterns(patterns)
+	}
+	addedPatterns, removedPatterns := diffLists(w.opts.Patterns, patterns)
+	addedFiles, removedFiles := diffLists(w.opts.Files, opts.Files)
+	w.opts.Patterns = patterns
+	w.opts.Files = opts.Files
+	w.opts.Delays = opts.Delays
+
+	old := w.watchAgain()
+	w.listMu.Lock()
+	var gone []string
+	for p := range old {
+		if _, ok := w.list[p]; !ok {
+			gone = append(gone, p)
+		}
+	}
+	added := 0
+	for p := range w.list {
+		if _, ok := old[p]; !ok {
+			added++
+		}
+	}
+	w.listMu.Unlock()
+	sort.Strings(gone)
+	for _, p := range gone {
+		w.verbosef(3, "No longer watching [%s]", p)
+		if err := w.source.Unwatch(p); err != nil {
+			w.tracef("Unable to stop watching %s: %v", p, err)
+		}
+	}
+
+	for _, p := range addedPatterns {
+		w.verbosef(1, "Pattern %s added", p)
+	}
+	for _, p := range removedPatterns {
+		w.verbosef(1, "Pattern %s removed", p)
+	}
+	changes := len(addedPatterns) + len(removedPatterns) + len(addedFiles) + len(removedFiles) + len(addedExcludes) + len(removedExcludes)
+	count := w.watchCount()
+	infof("reload", Fields{"changes": changes, "count": count, "added": added, "removed": len(gone)},
+		"Configuration reloaded: %d patterns added and %d removed, %d files added and %d removed, %d exclusions added and %d removed. "+
+			"Watching %d paths, %d new and %d no longer",
+		len(addedPatterns), len(removedPatterns), len(addedFiles), len(removedFiles), len(addedExcludes), len(removedExcludes),
+		count, added, len(gone))
+}
+
+// diffLists returns the items of b not in a, and the items of a not in b.
+func diffLists(a, b []string) (added, removed []string) {
+	in := func(list []string, s string) bool {
+		for _, item := range list {
+			if item == s {
+				return true
+			}
+		}
+		return false
+	}
+	for _, s := range b {
+		if !in(a, s) {
+			added = append(added, s)
+		}
+	}
+	for _, s := range a {
+		if !in(b, s) {
+			removed = append(removed, s)
+		}
+	}
+	return added, removed
+}
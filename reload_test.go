@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReloadWhileHandlingEvents(t *testing.T) {
+	if reloadSignal == nil {
+		t.Skip("No reload signal on this system")
+	}
+	logs := captureLog(t)
+	r := recordCommands(t)
+	dir, other := t.TempDir(), t.TempDir()
+	file := filepath.Join(dir, "a.txt")
+	writeFile(t, file)
+	writeFile(t, filepath.Join(other, "b.txt"))
+
+	// Keep the signal from stopping the test before Run listens to it
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, reloadSignal)
+	defer signal.Stop(sig)
+
+	var reloads int32
+	opts := testOptions(filepath.Join(dir, "*.txt"))
+	opts.Reload = func() (Options, error) {
+		// Watch the other directory every other time
+		patterns := []string{filepath.Join(dir, "*.txt")}
+		if atomic.AddInt32(&reloads, 1)%2 == 1 {
+			patterns = append(patterns, filepath.Join(other, "*.txt"))
+		}
+		return Options{Patterns: patterns}, nil
+	}
+	src := startRun(t, opts, file)
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const events = 20
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < events; i++ {
+			src.Send(file, "write")
+		}
+	}()
+	for i := 0; i < events; i++ {
+		if err := p.Signal(reloadSignal); err != nil {
+			t.Skipf("Unable to send the reload signal: %v", err)
+		}
+	}
+	<-done
+	waitRuns(t, r, events)
+	waitFor(t, "the configuration to reload", func() bool {
+		return strings.Contains(logs.String(), "Configuration reloaded")
+	})
+}
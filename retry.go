@@ -0,0 +1,94 @@
+package main
+
+import (
+	"time"
+)
+
+// Type retryState is a failed command waiting to run again, with
+// --retries.
+type retryState struct {
+	cmd []string
+	env map[string]string
+	// Number of the next attempt, starting at 1
+	attempt int
+	timer   *time.Timer
+}
+
+// RunCommand runs cmd for the rule with index rule, like runCommand, and
+// retries it up to --retries times if it fails. With --once, the retries
+// run right away; otherwise, they are scheduled after --retry-delay, and
+// cancelled by the next run of the rule. Must be called with runMu held.
+func (w *Watcher) RunCommand(rule int, cmd []string, env map[string]string) error {
+	w.cancelRetry(rule)
+	err := w.runCommand(rule, cmd, env)
+	// Commands run in the background with --restart are not retried
+	if err == nil || w.opts.Retries <= 0 || (w.opts.Restart && !w.opts.Once) {
+		return err
+	}
+	if !w.opts.Once {
+		w.scheduleRetry(rule, &retryState{cmd: cmd, env: env, attempt: 1})
+		return err
+	}
+	for attempt := 1; err != nil && attempt <= w.opts.Retries; attempt++ {
+		select {
+		case <-time.After(w.opts.RetryDelay):
+		case <-w.quit:
+			return err
+		}
+		infof("retry", Fields{"attempt": attempt}, "Retrying command, attempt %d of %d ...", attempt, w.opts.Retries)
+		err = w.runCommand(rule, cmd, env)
+	}
+	if err != nil {
+		errorf("retry", Fields{"exit_code": ExitCode(err)}, "Command failed after %d retries", w.opts.Retries)
+	}
+	return err
+}
+
+// scheduleRetry schedules the attempt r of the rule with index rule after
+// --retry-delay. Must be called with runMu held.
+func (w *Watcher) scheduleRetry(rule int, r *retryState) {
+	w.verbosef(1, "Command failed, retrying in %s", w.opts.RetryDelay)
+	r.timer = time.AfterFunc(w.opts.RetryDelay, func() {
+		select {
+		case w.retry <- rule:
+		case <-w.quit:
+		}
+	})
+	w.retries[rule] = r
+}
+
+// cancelRetry cancels the retries pending for the rule with index rule,
+// if any. Must be called with runMu held.
+func (w *Watcher) cancelRetry(rule int) {
+	if r, ok := w.retries[rule]; ok {
+		r.timer.Stop()
+		delete(w.retries, rule)
+		w.verbosef(1, "New run, cancelling the pending retries")
+	}
+}
+
+// Retry runs the pending retry for the rule with index rule, if not
+// cancelled, and schedules the next one if it fails again.
+func (w *Watcher) Retry(rule int) (bool, error) {
+	w.runMu.Lock()
+	defer w.runMu.Unlock()
+	r, ok := w.retries[rule]
+	if !ok {
+		return false, nil
+	}
+	delete(w.retries, rule)
+	if w.isPaused() {
+		return false, nil
+	}
+	infof("retry", Fields{"attempt": r.attempt}, "Retrying command, attempt %d of %d ...", r.attempt, w.opts.Retries)
+	err := w.runCommand(rule, r.cmd, r.env)
+	if err == nil {
+		return true, nil
+	}
+	if r.attempt < w.opts.Retries {
+		w.scheduleRetry(rule, &retryState{cmd: r.cmd, env: r.env, attempt: r.attempt + 1})
+	} else {
+		errorf("retry", Fields{"exit_code": ExitCode(err)}, "Command failed after %d retries", w.opts.Retries)
+	}
+	return true, err
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Separator between the patterns and the command of a --rule.
+const ruleSeparator = "=>"
+
+// Type Rule is a set of patterns and the command to run when a path
+// matching any of them changes.
+type Rule struct {
+	Patterns []string `json:"patterns"`
+	Command  []string `json:"command"`
+}
+
+// ParseRule parses a rule given as "patterns=>command", where patterns
+// is a comma-separated list of glob patterns, and command is run with
+// the shell.
+func ParseRule(spec string) (Rule, error) {
+	i := strings.Index(spec, ruleSeparator)
+	if i < 0 {
+		return Rule{}, fmt.Errorf("invalid rule %q, use patterns%scommand", spec, ruleSeparator)
+	}
+	var r Rule
+	for _, p := range strings.Split(spec[:i], ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			r.Patterns = append(r.Patterns, p)
+		}
+	}
+	if command := strings.TrimSpace(spec[i+len(ruleSeparator):]); command != "" {
+		r.Command = []string{command}
+	}
+	if len(r.Patterns) == 0 || len(r.Command) == 0 {
+		return Rule{}, fmt.Errorf("invalid rule %q, both patterns and a command are required", spec)
+	}
+	return r, nil
+}
+
+// Match reports whether path matches the rule: either one of its
+// patterns matches the path or its base name, or the path is inside a
+// directory matched by one of them.
+func (r Rule) Match(path string) bool {
+	path = normalizePath(path)
+	for _, p := range r.Patterns {
+		p = normalizePath(p)
+		if ok, _ := MatchGlob(p, path); ok {
+			return true
+		}
+		if !strings.ContainsRune(p, filepath.Separator) {
+			if ok, _ := filepath.Match(p, filepath.Base(path)); ok {
+				return true
+			}
+		}
+		glob, err := Glob(p)
+		if err != nil {
+			continue
+		}
+		for _, dir := range glob {
+			if !IsDir(dir) {
+				continue
+			}
+			if dir == "." && !filepath.IsAbs(path) && !strings.HasPrefix(path, "..") {
+				return true
+			}
+			if strings.HasPrefix(path, dir+string(filepath.Separator)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Type Rules is a list of rules given with --rule, implementing the
+// flag.Value interface.
+type Rules []Rule
+
+// Method String implements the flags.Value interface.
+func (r *Rules) String() string {
+	return fmt.Sprint(*r)
+}
+
+// Method Set implements the flags.Value interface.
+func (r *Rules) Set(value string) error {
+	rule, err := ParseRule(value)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, rule)
+	return nil
+}
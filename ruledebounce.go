@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Type ruleState is the state of the command of a rule, used to debounce
+// the changes per command with --debounce-per-command.
+type ruleState struct {
+	// Last time the command ran
+	last time.Time
+	// Whether the command is running in parallel, and the last change
+	// that arrived meanwhile, to run once it finishes
+	running bool
+	queued  *queuedRun
+}
+
+// Type queuedRun is a change waiting for the command of a rule to finish.
+type queuedRun struct {
+	path  string
+	event string
+	files []string
+}
+
+// ruleReady reports whether the command of the rule with index rule can
+// run for a change to path, with --debounce-per-command: it did not run
+// within the minimum interval for path, and is not running. A change that
+// arrives while it runs is kept, and runs once it finishes. Must be
+// called with runMu held.
+func (w *Watcher) ruleReady(rule int, path, event string, files []string) bool {
+	st, ok := w.rules[rule]
+	if !ok {
+		st = &ruleState{}
+		w.rules[rule] = st
+	}
+	if st.running {
+		w.verbosef(2, "Command of rule %d still running, waiting for it to finish", rule)
+		st.queued = &queuedRun{path: path, event: event, files: files}
+		return false
+	}
+	minInterval, _ := w.delaysFor(path)
+	if since := time.Since(st.last); minInterval > 0 && since < minInterval {
+		w.verbosef(2, "Command of rule %d ran %s ago, ignoring the change to %s", rule, since.Round(time.Millisecond), path)
+		return false
+	}
+	st.last = time.Now()
+	// Only commands run in parallel are still running once started
+	st.running = w.runsInParallel()
+	return true
+}
+
+// runsInParallel reports whether runCommand starts the commands in
+// parallel, and returns before they finish.
+func (w *Watcher) runsInParallel() bool {
+	return w.opts.Parallel > 1 && !w.opts.Once && !w.opts.DryRun && !w.opts.Restart
+}
+
+// ruleNotStarted records that the command of the rule with index rule did
+// not start after all, with --debounce-per-command, so that the next
+// change runs it. Unlike ruleFinished, it is called by the Run loop
+// itself. Must be called with runMu held.
+func (w *Watcher) ruleNotStarted(rule int) {
+	if st, ok := w.rules[rule]; ok {
+		st.running = false
+	}
+}
+
+// ruleFinished is called by the parallel run of the command of the rule
+// with index rule when it finishes, with --debounce-per-command.
+func (w *Watcher) ruleFinished(rule int) {
+	select {
+	case w.ruleDone <- rule:
+	case <-w.quit:
+	}
+}
+
+// RuleDone records that the command of the rule with index rule finished,
+// and runs it for the change that arrived meanwhile, if any.
+func (w *Watcher) RuleDone(rule int) (bool, error) {
+	w.runMu.Lock()
+	defer w.runMu.Unlock()
+	st, ok := w.rules[rule]
+	if !ok {
+		return false, nil
+	}
+	st.running = false
+	q := st.queued
+	if q == nil {
+		return false, nil
+	}
+	st.queued = nil
+	st.last = time.Now()
+	st.running = w.runsInParallel()
+	return true, w.executeRule(rule, w.ruleCommand(rule), q.path, q.event, q.files)
+}
+
+// ruleCommand returns the command of the rule with index rule, split in
+// arguments with --no-shell.
+func (w *Watcher) ruleCommand(rule int) []string {
+	if len(w.opts.Rules) == 0 {
+		return w.opts.Command
+	}
+	command := w.opts.Rules[rule].Command
+	if w.opts.NoShell && len(command) == 1 {
+		command = strings.Fields(command[0])
+	}
+	return command
+}
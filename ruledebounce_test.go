@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRuleNotStarted(t *testing.T) {
+	captureLog(t)
+	r := recordCommands(t)
+	opts := testOptions()
+	opts.Parallel = 2
+	opts.DebouncePerCommand = true
+	w := newTestWatcher(t, opts, NewMemorySource())
+
+	// The invalid template keeps the command from starting
+	w.opts.Command = []string{"true", "{{.Path"}
+	w.runMu.Lock()
+	ran, err := w.execute("a.txt", "write", nil)
+	w.runMu.Unlock()
+	if !ran || err == nil {
+		t.Fatalf("execute() = %v, %v, expected it to run and fail", ran, err)
+	}
+	if w.rules[0].running {
+		t.Fatalf("Command of rule 0 still running, but never started")
+	}
+
+	w.opts.Command = []string{"true"}
+	w.runMu.Lock()
+	ran, err = w.execute("a.txt", "write", nil)
+	w.runMu.Unlock()
+	if !ran || err != nil {
+		t.Fatalf("execute() = %v, %v, expected it to run", ran, err)
+	}
+	waitFor(t, "the command to run", func() bool { return r.count() == 1 })
+}
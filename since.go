@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ParseSince parses the --since cutoff, either a duration before now,
+// such as 10m, or a time in RFC 3339 format, such as
+// 2006-01-02T15:04:05Z07:00, or a date, such as 2006-01-02.
+func ParseSince(spec string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(spec); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", spec, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, spec)
+}
+
+// ModifiedSince returns the watched files modified after t, sorted by
+// path: the ones watched by themselves, and the ones inside the watched
+// directories that are not excluded and match --include.
+func (w *Watcher) ModifiedSince(t time.Time) []string {
+	w.listMu.Lock()
+	var paths []string
+	for p := range w.list {
+		paths = append(paths, p)
+	}
+	dirs := make(map[string]bool)
+	for p := range w.dirs {
+		dirs[p] = true
+	}
+	w.listMu.Unlock()
+
+	found := make(map[string]bool)
+	check := func(path string, info os.FileInfo) {
+		if info.Mode().IsRegular() && info.ModTime().After(t) && !w.IsExcluded(path, false) && w.IsIncluded(path) {
+			found[path] = true
+		}
+	}
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+		if !info.IsDir() {
+			check(p, info)
+			continue
+		}
+		// Parents of watched files are watched too, but not their
+		// other entries
+		if !dirs[p] {
+			continue
+		}
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if info, err := e.Info(); err == nil {
+				check(filepath.Join(p, e.Name()), info)
+			}
+		}
+	}
+	files := make([]string, 0, len(found))
+	for f := range found {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// RunSince runs the command for the watched files modified after the
+// --since cutoff, once for each file, or once for all of them in --batch
+// mode. WHENCHANGE_EVENT is startup-since for these runs. With --once,
+// only the first run happens.
+func (w *Watcher) RunSince() (bool, error) {
+	files := w.ModifiedSince(w.opts.Since)
+	w.verbosef(1, "%d files modified since %s", len(files), w.opts.Since.Format(time.RFC3339))
+	if len(files) == 0 {
+		return false, nil
+	}
+	w.runMu.Lock()
+	defer w.runMu.Unlock()
+	if w.opts.Batch {
+		w.verbosef(1, "%d files changed: %v", len(files), files)
+		return w.executeBatch(files, "startup-since")
+	}
+	ran := false
+	var err error
+	for _, f := range files {
+		r, e := w.execute(f, "startup-since", nil)
+		if r {
+			ran, err = true, e
+			if w.opts.Once {
+				break
+			}
+		}
+	}
+	return ran, err
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Suffixes accepted by ParseSize, as multiples of 1024, from the longer
+// to the shorter ones so that the first match is the right one.
+var sizeSuffixes = []struct {
+	suffix string
+	scale  float64
+}{
+	{"kib", 1 << 10},
+	{"mib", 1 << 20},
+	{"gib", 1 << 30},
+	{"kb", 1 << 10},
+	{"mb", 1 << 20},
+	{"gb", 1 << 30},
+	{"k", 1 << 10},
+	{"m", 1 << 20},
+	{"g", 1 << 30},
+	{"b", 1},
+}
+
+// ParseSize parses a file size, in bytes or with a K, M or G suffix, with
+// an optional B or iB, like 512, 100K or 1.5MB. The suffixes are not case
+// sensitive, and are multiples of 1024.
+func ParseSize(s string) (int64, error) {
+	num, scale := strings.TrimSpace(s), 1.0
+	lower := strings.ToLower(num)
+	for _, u := range sizeSuffixes {
+		if strings.HasSuffix(lower, u.suffix) {
+			num, scale = strings.TrimSpace(num[:len(num)-len(u.suffix)]), u.scale
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * scale), nil
+}
+
+// sizeInRange returns whether the size of the file at path is within
+// --min-size and --max-size. Directories, and files that can not be
+// read, like deleted ones, are always in range.
+func (w *Watcher) sizeInRange(path string) bool {
+	if w.opts.MinSize == 0 && w.opts.MaxSize == 0 {
+		return true
+	}
+	fi, err := os.Stat(path)
+	if err != nil || fi.IsDir() {
+		return true
+	}
+	if fi.Size() < w.opts.MinSize {
+		return false
+	}
+	return w.opts.MaxSize == 0 || fi.Size() <= w.opts.MaxSize
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gopkg.in/fsnotify.v0"
+)
+
+// Type Event is a change to a watched path, as delivered by an
+// EventSource.
+type Event struct {
+	// Path that changed
+	Name string
+	// Event type, as used by --events, or unknown
+	Op string
+	// Details of the event as received from the source, for --trace
+	Raw string
+}
+
+// Method String implements the fmt.Stringer interface.
+func (ev Event) String() string {
+	return fmt.Sprintf("%q: %s", ev.Name, strings.ToUpper(ev.Op))
+}
+
+// Type EventSource watches paths and delivers their changes. Changes to
+// the entries of a watched directory are delivered as well.
+type EventSource interface {
+	// Watch starts delivering the changes to path
+	Watch(path string) error
+	// Unwatch stops delivering the changes to path
+	Unwatch(path string) error
+	// Events returns the channel the changes are delivered to
+	Events() <-chan Event
+	// Errors returns the channel the errors are delivered to
+	Errors() <-chan error
+	// Close stops watching all paths
+	Close() error
+}
+
+// Event type names accepted by --events, and the matching fsnotify
+// predicates.
+var eventPredicates = map[string]func(ev *fsnotify.FileEvent) bool{
+	// Attribute changes are reported as modifications too
+	"write":  func(ev *fsnotify.FileEvent) bool { return ev.IsModify() && !ev.IsAttrib() },
+	"create": func(ev *fsnotify.FileEvent) bool { return ev.IsCreate() },
+	"delete": func(ev *fsnotify.FileEvent) bool { return ev.IsDelete() },
+	"rename": func(ev *fsnotify.FileEvent) bool { return ev.IsRename() },
+	"attrib": func(ev *fsnotify.FileEvent) bool { return ev.IsAttrib() },
+}
+
+// EventName returns the name of the event type of ev, as used by --events.
+func EventName(ev *fsnotify.FileEvent) string {
+	for _, name := range []string{"create", "delete", "rename", "attrib", "write"} {
+		if eventPredicates[name](ev) {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// decodeFlags describes all the predicates of ev, as an event can match
+// more than one of them.
+func decodeFlags(ev *fsnotify.FileEvent) string {
+	return fmt.Sprintf("%s create=%t modify=%t delete=%t rename=%t attrib=%t",
+		ev, ev.IsCreate(), ev.IsModify(), ev.IsDelete(), ev.IsRename(), ev.IsAttrib())
+}
+
+// Type FsnotifySource is the EventSource using the file system events
+// from fsnotify.
+type FsnotifySource struct {
+	*fsnotify.Watcher
+	events chan Event
+	done   chan struct{}
+}
+
+// NewFsnotifySource returns a new FsnotifySource.
+func NewFsnotifySource() (*FsnotifySource, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	s := &FsnotifySource{
+		Watcher: fsw,
+		events:  make(chan Event),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		for ev := range fsw.Event {
+			select {
+			case s.events <- Event{Name: ev.Name, Op: EventName(ev), Raw: decodeFlags(ev)}:
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return s, nil
+}
+
+// Method Unwatch implements the EventSource interface.
+func (s *FsnotifySource) Unwatch(path string) error {
+	return s.Watcher.RemoveWatch(path)
+}
+
+// Method Events implements the EventSource interface.
+func (s *FsnotifySource) Events() <-chan Event {
+	return s.events
+}
+
+// Method Errors implements the EventSource interface.
+func (s *FsnotifySource) Errors() <-chan error {
+	return s.Watcher.Error
+}
+
+// Method Close implements the EventSource interface.
+func (s *FsnotifySource) Close() error {
+	close(s.done)
+	return s.Watcher.Close()
+}
+
+// Type listSource is the EventSource used with --list. It records the
+// paths to watch, without watching them, and delivers no events.
+type listSource struct {
+	paths []string
+}
+
+// Method Watch implements the EventSource interface.
+func (s *listSource) Watch(path string) error {
+	s.paths = append(s.paths, path)
+	return nil
+}
+
+// Method Unwatch implements the EventSource interface.
+func (s *listSource) Unwatch(path string) error {
+	return nil
+}
+
+// Method Events implements the EventSource interface.
+func (s *listSource) Events() <-chan Event {
+	return nil
+}
+
+// Method Errors implements the EventSource interface.
+func (s *listSource) Errors() <-chan error {
+	return nil
+}
+
+// Method Close implements the EventSource interface.
+func (s *listSource) Close() error {
+	return nil
+}
+
+// Type MemorySource is an EventSource that watches nothing, and delivers
+// the events given to Send instead, for the paths being watched, so that
+// the Watcher can be driven without waiting for the file system.
+type MemorySource struct {
+	mu     sync.Mutex
+	paths  map[string]bool
+	events chan Event
+	errors chan error
+}
+
+// NewMemorySource returns a new MemorySource.
+func NewMemorySource() *MemorySource {
+	return &MemorySource{
+		paths:  make(map[string]bool),
+		events: make(chan Event),
+		errors: make(chan error),
+	}
+}
+
+// Method Watch implements the EventSource interface.
+func (s *MemorySource) Watch(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paths[normalizePath(path)] = true
+	return nil
+}
+
+// Method Unwatch implements the EventSource interface.
+func (s *MemorySource) Unwatch(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.paths, normalizePath(path))
+	return nil
+}
+
+// Watched reports whether path, or the directory it is in, is watched.
+func (s *MemorySource) Watched(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path = normalizePath(path)
+	return s.paths[path] || s.paths[filepath.Dir(path)]
+}
+
+// Send delivers the event op on path, as a file system change would, and
+// reports whether it was delivered: events on paths not watched are
+// dropped. It blocks until the event is received.
+func (s *MemorySource) Send(path, op string) bool {
+	if !s.Watched(path) {
+		return false
+	}
+	s.events <- Event{Name: path, Op: op, Raw: fmt.Sprintf("%q: %s", path, strings.ToUpper(op))}
+	return true
+}
+
+// Fail delivers err, as a failure of the file system watches would. It
+// blocks until the error is received.
+func (s *MemorySource) Fail(err error) {
+	s.errors <- err
+}
+
+// Method Events implements the EventSource interface.
+func (s *MemorySource) Events() <-chan Event {
+	return s.events
+}
+
+// Method Errors implements the EventSource interface.
+func (s *MemorySource) Errors() <-chan error {
+	return s.errors
+}
+
+// Method Close implements the EventSource interface.
+func (s *MemorySource) Close() error {
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+// Type WatchState is the directory tree found while watching, saved to
+// the --state-file so that the next run does not need to walk all of it
+// again.
+type WatchState struct {
+	// Options the tree was found with. If they differ, the state is not
+	// used.
+	Patterns  []string `json:"patterns"`
+	Exclude   []string `json:"exclude"`
+	Gitignore bool     `json:"gitignore"`
+	// Directories found, by path
+	Dirs map[string]DirState `json:"dirs"`
+}
+
+// Type DirState is a directory in the WatchState, with its modification
+// time and sub-directories.
+type DirState struct {
+	ModTime time.Time `json:"modTime"`
+	Subdirs []string  `json:"subdirs"`
+}
+
+// newWatchState returns an empty WatchState for opts.
+func newWatchState(opts Options) *WatchState {
+	return &WatchState{
+		Patterns:  opts.Patterns,
+		Exclude:   opts.Exclude,
+		Gitignore: opts.Gitignore,
+		Dirs:      make(map[string]DirState),
+	}
+}
+
+// ReadWatchState reads the state saved at path, if any, and returns it if
+// it was saved with the same options as opts.
+func ReadWatchState(path string, opts Options) (*WatchState, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	s := &WatchState{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	want := newWatchState(opts)
+	if !reflect.DeepEqual(s.Patterns, want.Patterns) || !reflect.DeepEqual(s.Exclude, want.Exclude) || s.Gitignore != want.Gitignore {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// Write saves the state to path.
+func (s *WatchState) Write(path string) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
+
+// loadState reads the --state-file, if given, to use while walking the
+// watched directories.
+func (w *Watcher) loadState() {
+	if w.opts.StateFile == "" {
+		return
+	}
+	w.state = newWatchState(w.opts)
+	cached, err := ReadWatchState(w.opts.StateFile, w.opts)
+	if err != nil {
+		warnf("state", Fields{"path": w.opts.StateFile, "error": err.Error()}, "Unable to load state from %s: %v", w.opts.StateFile, err)
+		return
+	}
+	if cached == nil {
+		w.verbosef(1, "No saved state for these patterns in %s, walking all directories", w.opts.StateFile)
+		return
+	}
+	w.verbosef(1, "Loaded %d directories from %s", len(cached.Dirs), w.opts.StateFile)
+	w.cached = cached
+}
+
+// saveState writes the directory tree found to the --state-file, if given.
+func (w *Watcher) saveState() {
+	if w.state == nil {
+		return
+	}
+	if err := w.state.Write(w.opts.StateFile); err != nil {
+		warnf("state", Fields{"path": w.opts.StateFile, "error": err.Error()}, "Unable to save state to %s: %v", w.opts.StateFile, err)
+	}
+}
+
+// cachedDir returns the saved state of dir, if any.
+func (w *Watcher) cachedDir(dir string) (DirState, bool) {
+	if w.cached == nil {
+		return DirState{}, false
+	}
+	d, ok := w.cached.Dirs[dir]
+	return d, ok
+}
+
+// WalkDirs returns path and all the directories below it, like SubDirs.
+// Directories that did not change since the saved state was written are
+// not read again, and their sub-directories are taken from the state.
+func (w *Watcher) WalkDirs(path string) []string {
+	var paths []string
+	var walk func(dir string)
+	walk = func(dir string) {
+		info, err := os.Lstat(dir)
+		if err != nil || !info.IsDir() || w.IsExcluded(dir, true) || (dir != path && w.isHidden(dir)) {
+			return
+		}
+		paths = append(paths, dir)
+		if w.opts.Gitignore {
+			w.LoadGitignore(dir)
+		}
+		var subdirs []string
+		if d, ok := w.cachedDir(dir); ok && d.ModTime.Equal(info.ModTime()) {
+			subdirs = d.Subdirs
+		} else {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				return
+			}
+			for _, e := range entries {
+				if e.IsDir() {
+					subdirs = append(subdirs, filepath.Join(dir, e.Name()))
+				}
+			}
+		}
+		w.state.Dirs[dir] = DirState{ModTime: info.ModTime(), Subdirs: subdirs}
+		for _, s := range subdirs {
+			walk(s)
+		}
+	}
+	walk(path)
+	return paths
+}
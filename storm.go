@@ -0,0 +1,50 @@
+package main
+
+import (
+	"time"
+)
+
+// Number of distinct paths changed one after the other, each within
+// stormWindow of the previous event being handled, taken as a bulk
+// operation, like a git checkout or an rm -rf of a tree, and the quiet
+// period after which the command runs once for all of the changes. The
+// time is counted once the previous event was handled, as the events
+// queue up while the command runs. With a delay, the leading runs wait
+// for stormWindow, so that the changes at the start of a bulk operation
+// are collected too.
+const (
+	stormPaths  = 50
+	stormWindow = 200 * time.Millisecond
+	stormSettle = time.Second
+)
+
+// inStorm records the change to path, and reports whether it is part of
+// a bulk operation. In that case the change, and the ones waiting for
+// --debounce=trailing, are added to the batch, to run the command once
+// no change arrived for stormSettle, or settle if longer. Must be called
+// with runMu held.
+func (w *Watcher) inStorm(path, event string, settle time.Duration) bool {
+	if !w.storming {
+		if w.stormSeen == nil || time.Since(w.handled) > stormWindow {
+			w.stormSeen = make(map[string]bool)
+		}
+		w.stormSeen[path] = true
+		if len(w.stormSeen) < stormPaths {
+			return false
+		}
+		w.storming = true
+		w.stormSeen = nil
+		infof("storm", Fields{"count": stormPaths}, "%d paths changed at once, waiting for the changes to settle", stormPaths)
+		for key, ch := range w.pending {
+			w.timers[key].Stop()
+			delete(w.pending, key)
+			delete(w.timers, key)
+			w.addToBatch(ch.path, ch.event, stormSettle)
+		}
+	}
+	if settle < stormSettle {
+		settle = stormSettle
+	}
+	w.addToBatch(path, event, settle)
+	return true
+}
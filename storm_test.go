@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunStorm(t *testing.T) {
+	captureLog(t)
+	r := recordCommands(t)
+	dir := t.TempDir()
+	var files []string
+	for i := 0; i < stormPaths+10; i++ {
+		file := filepath.Join(dir, fmt.Sprintf("%02d.txt", i))
+		writeFile(t, file)
+		files = append(files, file)
+	}
+
+	opts := testOptions(filepath.Join(dir, "*.txt"))
+	opts.MinInterval = time.Second
+	src := startRun(t, opts, files[len(files)-1])
+	for _, f := range files {
+		if !src.Send(f, "write") {
+			t.Fatalf("Event on %s not delivered", f)
+		}
+	}
+	// The batch runs once no change arrived for stormSettle
+	time.Sleep(stormSettle)
+	waitRuns(t, r, 1)
+}
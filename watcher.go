@@ -0,0 +1,1761 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Event types that trigger the command by default.
+const defaultEvents = "write,create"
+
+// Number of watched paths after which a hint about the inotify limit is
+// logged. It is the default fs.inotify.max_user_watches of older kernels.
+const watchesHint = 8192
+
+// Interval used to poll the watched paths when file system events are not
+// available.
+const fallbackPoll = time.Second
+
+// Delays before watching all paths again after an error from the event
+// source. The delay doubles with each error arriving less than
+// maxRewatchDelay after the last time.
+const (
+	minRewatchDelay = time.Second
+	maxRewatchDelay = time.Minute
+)
+
+// Interval at which the changes ignored for being too fast are summed up
+// in the log, instead of logging each of them.
+const ignoredSummaryInterval = 5 * time.Second
+
+// Error returned by Watch when --max-watches paths are watched already.
+var errMaxWatches = errors.New("too many watched paths")
+
+// Debounce modes accepted by --debounce. Leading runs the command on the
+// first change and ignores the next ones for the delay; trailing waits
+// until no change arrived for the delay, and runs on the last one.
+const (
+	debounceLeading  = "leading"
+	debounceTrailing = "trailing"
+)
+
+// Type Options holds the settings used by Run to watch for changes and
+// run the command. The command line flags map to its fields.
+type Options struct {
+	// Files and directories to watch, as glob patterns
+	Patterns []string
+	// Files and directories to watch as they are, without expanding
+	// wildcards
+	Files []string
+	// Files and directories to skip, as glob patterns
+	Exclude []string
+	// Files that trigger the command, as glob patterns, all if empty
+	Include []string
+	// Skip paths ignored by .gitignore files
+	Gitignore bool
+	// Watch directories recursively
+	Recursive bool
+	// Walk the targets of symlinks to directories when recursive
+	FollowSymlinks bool
+	// Watch the hidden paths matched by wildcards, or found when
+	// recursive, which are skipped otherwise
+	WatchHidden bool
+	// Minimum time between executions of the command for the same
+	// path, 0 or less means no limit. Set with --delay or --min-interval.
+	MinInterval time.Duration
+	// Time without changes to wait for before running the command, with
+	// --debounce=trailing or --batch, 0 or less means not waiting. Set
+	// with --delay or --settle.
+	Settle time.Duration
+	// Delays given with the patterns, used instead of MinInterval and
+	// Settle for the paths matching them
+	Delays []PatternDelay
+	// Maximum random delay added before running the command for a change,
+	// 0 means none
+	Jitter time.Duration
+	// Interval to poll the watched paths at, instead of using file
+	// system events, 0 means no polling
+	Poll time.Duration
+	// Source of the changes to use instead of the file system events or
+	// polling, such as a MemorySource. Run closes it when done.
+	Source EventSource
+	// Reads the options again on SIGHUP, to watch the new patterns,
+	// files and exclusions. Nil means not reloading them.
+	Reload func() (Options, error)
+	// Maximum number of watched paths, 0 means no limit
+	MaxWatches int
+	// Watch files only through the directory they are in, which reports
+	// the changes to its entries, instead of watching each one too
+	DirWatchOnly bool
+	// Debounce mode, leading or trailing
+	Debounce string
+	// Debounce the changes per command, or per rule, instead of per path
+	DebouncePerCommand bool
+	// Handle the events of an editor atomic save as a single write
+	CoalesceSaves bool
+	// Skip write and attribute change events when the modification time,
+	// size and mode of the file did not change
+	CheckMtime bool
+	// Skip all events unless the modification time of the file advanced,
+	// instead of CheckMtime
+	WatchMtimeOnly bool
+	// Skip events for files smaller or larger than these sizes, in bytes,
+	// 0 means no limit
+	MinSize int64
+	MaxSize int64
+	// Event types that trigger the command
+	Events EventTypes
+	// Only run the command for paths created after they were watched,
+	// ignoring changes to the existing ones
+	WatchNewOnly bool
+	// Shell used to run the command, and whether to run it directly
+	// instead
+	Shell   string
+	NoShell bool
+	// Arguments given to the shell before the command string
+	ShellArgs []string
+	// Command to run on changes, or a script to run with the shell
+	Command     []string
+	CommandFile string
+	// Run the command when the command file changes, if watched
+	WatchCommandFile bool
+	// Patterns and commands to run for them, instead of Command
+	Rules []Rule
+	// Run only the first rule matching a change, instead of all of them
+	FirstMatch bool
+	// Directory to run the command from, instead of the current one
+	WorkingDir string
+	// Give the changed paths to the command as absolute paths
+	AbsolutePaths bool
+	// Run the command in a pseudo-terminal, as if interactive
+	PTY bool
+	// Label added to the start of each line of the command output
+	Prefix string
+	// File to save the watched directory tree to, and load it from on
+	// the next run
+	StateFile string
+	// File with the environment variables to add for the command, read
+	// before each run
+	EnvFile string
+	// File to give to the command as its stdin, read before each run, if
+	// not empty
+	StdinFile string
+	// Give the command the stdin of whenchange, instead of /dev/null
+	InheritStdin bool
+	// Commands run with the shell before and after each run of the
+	// command, if not empty
+	Pre  string
+	Post string
+	// Command run with the shell after each failed run of the command, if
+	// not empty
+	OnError string
+	// Kill the running command when a new change arrives
+	Restart bool
+	// Ignore the changes made while the command runs, and until the
+	// settle time passed after it exits
+	IgnoreDuringRun bool
+	// Maximum time the command is allowed to run, 0 means no limit
+	Timeout time.Duration
+	// Time a command is given to exit after SIGTERM, when stopped by a
+	// new change, a timeout or on exit, before it gets SIGKILL
+	Grace time.Duration
+	// Maximum number of commands run at the same time, without waiting
+	// for each other to finish. 0 or 1 runs them one after the other.
+	Parallel int
+	// Times to run the command again when it fails, and the delay
+	// before each attempt
+	Retries    int
+	RetryDelay time.Duration
+	// Consecutive failed runs after which the runs are paused, 0 means
+	// never, and the file whose changes resume them
+	FailFast  int
+	ResetFile string
+	// Return after the first change, with the command exit code
+	Once bool
+	// Send a desktop notification after each run
+	Notify bool
+	// Log the command instead of running it
+	DryRun bool
+	// Print the paths that would be watched to stdout, and return
+	// without watching them
+	List bool
+	// Run the command once for all changes, after a quiet delay
+	Batch bool
+	// Run the command once for each directory with changes, like Batch
+	GroupByDir bool
+	// Write the changed files to the command stdin in batch mode, one
+	// per line
+	FilesToStdin bool
+	// Write the changed files to a temporary file in batch mode, one per
+	// line, and give its path to the command
+	FilesTmpfile bool
+	// Address to serve the status and trigger endpoints on, such as
+	// localhost:8080, if not empty
+	HTTPAddr string
+	// Address to serve the Prometheus metrics on, if not empty
+	MetricsAddr string
+	// Run the command once at startup
+	RunOnStart bool
+	// Run the command at startup for the files modified after this
+	// time, if not zero
+	Since time.Time
+	// Level of verbose output, 0 for none: 1 logs the settings and the
+	// changes that run the command, 2 adds the events ignored and why,
+	// and 3 the changes to the watch list
+	Verbosity int
+	// Log every event received, and how it was handled
+	Trace bool
+	// Log the number of runs, failures and time spent running the
+	// command when exiting
+	SummaryOnExit bool
+	// Interval to log that the paths are still watched at, 0 means never
+	Heartbeat time.Duration
+}
+
+// Type ExitStatus is the error returned by Run when the command failed.
+type ExitStatus int
+
+// Method Error implements the error interface.
+func (s ExitStatus) Error() string {
+	return fmt.Sprintf("command exited with status %d", int(s))
+}
+
+// exitStatus returns the ExitStatus error for code, or nil if code is 0.
+func exitStatus(code int) error {
+	if code == 0 {
+		return nil
+	}
+	return ExitStatus(code)
+}
+
+// setDefaults sets the options left empty to their default values.
+func (opts *Options) setDefaults() {
+	if opts.Shell == "" {
+		opts.Shell = "bash"
+	}
+	if opts.ShellArgs == nil {
+		opts.ShellArgs = []string{"-c"}
+	}
+	if opts.Events == nil {
+		opts.Events, _ = ParseEventTypes(defaultEvents)
+	}
+	if opts.Debounce == "" {
+		opts.Debounce = debounceLeading
+	}
+	if opts.Parallel < 1 {
+		opts.Parallel = 1
+	}
+	// Grouping collects the changes like a batch
+	if opts.GroupByDir {
+		opts.Batch = true
+	}
+}
+
+// Run watches the paths in opts and runs the command when they change,
+// until ctx is done. In that case, it stops the running command and
+// returns an ExitStatus with the last failing exit code, if any. With
+// opts.Once, it returns after the first run instead.
+func Run(ctx context.Context, opts Options) error {
+	if opts.CommandFile != "" && len(opts.Command) > 0 {
+		return errors.New("both a command file and a command were given")
+	}
+	if len(opts.Rules) > 0 && (opts.CommandFile != "" || len(opts.Command) > 0) {
+		return errors.New("both rules and a command were given")
+	}
+	if opts.WorkingDir != "" {
+		if s, err := os.Stat(opts.WorkingDir); err != nil {
+			return fmt.Errorf("invalid working directory: %v", err)
+		} else if !s.IsDir() {
+			return fmt.Errorf("invalid working directory: %s is not a directory", opts.WorkingDir)
+		}
+		// The command file is given relative to the current directory
+		if opts.CommandFile != "" {
+			abs, err := filepath.Abs(opts.CommandFile)
+			if err != nil {
+				return err
+			}
+			opts.CommandFile = abs
+		}
+	}
+	// Watch the paths of all rules
+	patterns := append([]string(nil), opts.Patterns...)
+	for _, r := range opts.Rules {
+		patterns = append(patterns, r.Patterns...)
+	}
+	opts.Patterns = patterns
+	opts.setDefaults()
+
+	source := opts.Source
+	if opts.List {
+		source = &listSource{}
+	} else if source == nil && opts.Poll > 0 {
+		source = NewPoller(opts.Poll)
+	} else if source == nil {
+		s, err := NewFsnotifySource()
+		if err != nil {
+			warnf("watch", Fields{"error": err.Error()}, "Unable to use file system events: %v. Polling every %s instead", err, fallbackPoll)
+			opts.Poll = fallbackPoll
+			source = NewPoller(fallbackPoll)
+		} else {
+			source = s
+		}
+	}
+	w := newWatcher(ctx, opts, source)
+	defer source.Close()
+
+	w.verbosef(1, "Command to execute: %v", opts.Command)
+	for _, r := range opts.Rules {
+		w.verbosef(1, "Rule: %v => %v", r.Patterns, r.Command)
+	}
+	if opts.Gitignore {
+		w.LoadParentGitignores(".")
+	}
+
+	if opts.Recursive {
+		w.opts.Patterns = w.SubsumePatterns(w.opts.Patterns)
+	}
+	w.verbosef(1, "Path list %v", w.opts.Patterns)
+	w.loadState()
+	w.WatchPatterns(w.opts.Patterns)
+	w.WatchFiles(w.opts.Files)
+	if s, ok := source.(*listSource); ok {
+		sort.Strings(s.paths)
+		for _, p := range s.paths {
+			fmt.Println(p)
+		}
+		fmt.Printf("%d paths would be watched\n", len(s.paths))
+		return nil
+	}
+	w.saveState()
+	if opts.FailFast > 0 && opts.ResetFile != "" {
+		w.watchResetFile()
+	}
+	if w.watchCount() == 0 {
+		warnf("watch", nil, "No paths are being watched, check the patterns %v", w.opts.Patterns)
+	}
+
+	if opts.HTTPAddr != "" {
+		srv, err := w.StartHTTP(opts.HTTPAddr)
+		if err != nil {
+			return err
+		}
+		defer srv.Close()
+	}
+	if opts.MetricsAddr != "" {
+		srv, err := w.StartMetrics(opts.MetricsAddr)
+		if err != nil {
+			return err
+		}
+		defer srv.Close()
+	}
+
+	if opts.RunOnStart {
+		if ran, err := w.RunOnStart(); ran && opts.Once {
+			return exitStatus(ExitCode(err))
+		}
+	}
+	if !opts.Since.IsZero() {
+		if ran, err := w.RunSince(); ran && opts.Once {
+			return exitStatus(ExitCode(err))
+		}
+	}
+
+	resume := make(chan os.Signal, 1)
+	if opts.FailFast > 0 && resumeSignal != nil {
+		signal.Notify(resume, resumeSignal)
+		defer signal.Stop(resume)
+	}
+	reload := make(chan os.Signal, 1)
+	if opts.Reload != nil && reloadSignal != nil {
+		signal.Notify(reload, reloadSignal)
+		defer signal.Stop(reload)
+	}
+	var heartbeat <-chan time.Time
+	if opts.Heartbeat > 0 {
+		t := time.NewTicker(opts.Heartbeat)
+		defer t.Stop()
+		heartbeat = t.C
+	}
+	w.handled = time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			infof("shutdown", nil, "Shutting down...")
+			w.runMu.Lock()
+			w.stopAll()
+			w.runMu.Unlock()
+			w.workers.Wait()
+			if opts.SummaryOnExit {
+				w.logSummary()
+			}
+			return exitStatus(w.ExitCode())
+		case ev := <-source.Events():
+			w.tracef("Received %s", ev.Raw)
+			if ran, err := w.HandleEvent(ev); ran && opts.Once {
+				return exitStatus(ExitCode(err))
+			}
+		case <-w.batchTimer.C:
+			if ran, err := w.FlushBatch(); ran && opts.Once {
+				return exitStatus(ExitCode(err))
+			}
+		case key := <-w.fire:
+			if ran, err := w.FlushPending(key); ran && opts.Once {
+				return exitStatus(ExitCode(err))
+			}
+		case <-w.trigger:
+			if ran, err := w.Trigger(); ran && opts.Once {
+				return exitStatus(ExitCode(err))
+			}
+		case rule := <-w.retry:
+			if ran, err := w.Retry(rule); ran && opts.Once {
+				return exitStatus(ExitCode(err))
+			}
+		case rule := <-w.ruleDone:
+			w.RuleDone(rule)
+		case <-w.rewatchTimer.C:
+			w.Rewatch()
+		case <-w.ignoredTimer.C:
+			w.FlushIgnored()
+		case <-resume:
+			w.Resume("SIGUSR1 received")
+		case <-reload:
+			w.Reload()
+		case <-heartbeat:
+			w.Heartbeat()
+		case err, ok := <-source.Errors():
+			if !ok {
+				// Not recoverable, no more events will arrive
+				w.runMu.Lock()
+				w.stopAll()
+				w.runMu.Unlock()
+				if opts.SummaryOnExit {
+					w.logSummary()
+				}
+				return errors.New("file system events are no longer available")
+			}
+			w.HandleError(err)
+		}
+	}
+}
+
+// newWatcher returns a Watcher for opts, getting the changes from source,
+// and stopping the commands once ctx is done.
+func newWatcher(ctx context.Context, opts Options, source EventSource) *Watcher {
+	w := &Watcher{
+		source:          source,
+		opts:            opts,
+		quit:            ctx.Done(),
+		list:            make(map[string]*watchEntry),
+		dirs:            make(map[string]bool),
+		gitignoreLoaded: make(map[string]bool),
+		pending:         make(map[string]pendingChange),
+		running:         make(map[int]*runningCommand),
+		renamed:         make(map[string]time.Time),
+		ignored:         make(map[string]int),
+		timers:          make(map[string]*time.Timer),
+		fire:            make(chan string),
+		retries:         make(map[int]*retryState),
+		retry:           make(chan int),
+		rules:           make(map[int]*ruleState),
+		ruleDone:        make(chan int),
+		trigger:         make(chan struct{}, 1),
+		slots:           make(chan struct{}, opts.Parallel),
+	}
+	// Only started once a change arrives in --batch mode
+	w.batchTimer = time.NewTimer(time.Hour)
+	w.batchTimer.Stop()
+	w.rewatchTimer = time.NewTimer(time.Hour)
+	w.rewatchTimer.Stop()
+	w.ignoredTimer = time.NewTimer(time.Hour)
+	w.ignoredTimer.Stop()
+	return w
+}
+
+// Type EventTypes is a set of event type names that trigger the command.
+type EventTypes []string
+
+// ParseEventTypes parses a comma-separated list of event type names.
+func ParseEventTypes(spec string) (EventTypes, error) {
+	var e EventTypes
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, ok := eventPredicates[name]; !ok {
+			return nil, fmt.Errorf("unknown event type %q", name)
+		}
+		e = append(e, name)
+	}
+	return e, nil
+}
+
+// Has reports whether name is one of the event types.
+func (e EventTypes) Has(name string) bool {
+	for _, n := range e {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports whether ev is of any of the event types.
+func (e EventTypes) Match(ev Event) bool {
+	return e.Has(ev.Op)
+}
+
+type Watcher struct {
+	// Source of the changes to the watched paths
+	source EventSource
+	opts   Options
+	// Closed when Run is asked to return
+	quit <-chan struct{}
+	// Watched paths, with the last time they triggered the command, and
+	// directories watched for their own sake, and not only as the parent
+	// of a watched file: changes to their children trigger the command
+	// too. Paths are cleaned, to match the names in the events. Guarded
+	// by listMu, and only accessed through the helpers below.
+	list   map[string]*watchEntry
+	dirs   map[string]bool
+	listMu sync.Mutex
+	// Number of paths in list watched through their directory, with
+	// --dir-watch-only, which use no watch of their own
+	viaDir int
+	// Serializes command runs, and guards the fields below.
+	runMu sync.Mutex
+	// Whether the warnings about the number of watched paths were
+	// logged already
+	maxWatchesWarned  bool
+	watchesHintLogged bool
+	// Directory tree found while watching, and the one loaded from the
+	// --state-file, if any
+	state  *WatchState
+	cached *WatchState
+	// Rules loaded from .gitignore files, and the directories they
+	// came from
+	gitignoreRules  IgnoreRules
+	gitignoreLoaded map[string]bool
+	// Commands still running in --restart mode, by rule index.
+	running map[int]*runningCommand
+	// Paths changed since the last run in --batch mode, the timer that
+	// fires once no change arrived for the settle time, and the time of
+	// the last run.
+	batch      []string
+	batchEvent string
+	batchTimer *time.Timer
+	batchRun   time.Time
+	// Last time an event was handled, and the paths changed one right
+	// after the other since, to detect bulk operations, and whether one
+	// is settling, its changes added to the batch
+	handled   time.Time
+	stormSeen map[string]bool
+	storming  bool
+	// Paths renamed recently, to recognize atomic saves. Only accessed
+	// by HandleEvent.
+	renamed map[string]time.Time
+	// Last watched directory renamed away, to follow it once created
+	// with another name. Only accessed by HandleEvent.
+	moved *movedTree
+	// Changes ignored for being too fast by path, logged together with
+	// --verbose when the timer fires. Only accessed by the Run loop.
+	ignored      map[string]int
+	ignoredTimer *time.Timer
+	// Last change to each watched path in --debounce=trailing mode, and
+	// the timers that send the path to fire once no change arrived for
+	// the delay.
+	pending map[string]pendingChange
+	timers  map[string]*time.Timer
+	fire    chan string
+	// Failed commands waiting to run again with --retries, by rule
+	// index, and the channel their timers send the rule index to
+	retries map[int]*retryState
+	retry   chan int
+	// State of the command of each rule, by rule index, and the channel
+	// their parallel runs send the rule index to when finished, with
+	// --debounce-per-command
+	rules    map[int]*ruleState
+	ruleDone chan int
+	// With --parallel, holds a value for each command running, and
+	// tracks the runs not finished yet, waiting or running. Commands
+	// write their output holding outputMu.
+	slots    chan struct{}
+	workers  sync.WaitGroup
+	outputMu sync.Mutex
+	// After an error from the event source, the timer that fires when
+	// all paths are watched again, the current delay before that, and
+	// the last time it was done. Only accessed by the Run loop.
+	rewatchTimer     *time.Timer
+	rewatchScheduled bool
+	rewatchDelay     time.Duration
+	rewatched        time.Time
+	// Last non-zero exit code of the command, or 0 if all runs
+	// succeeded. Accessed atomically.
+	exitCode int32
+	// Result of the last run, and the runs asked for with --http-addr
+	status  runStatus
+	trigger chan struct{}
+}
+
+// recordExit keeps track of the exit code of a command that returned err.
+func (w *Watcher) recordExit(err error) {
+	if code := ExitCode(err); code != 0 {
+		atomic.StoreInt32(&w.exitCode, int32(code))
+	}
+}
+
+// ExitCode returns the last non-zero exit code of the command, or 0.
+func (w *Watcher) ExitCode() int {
+	return int(atomic.LoadInt32(&w.exitCode))
+}
+
+// Type watchEntry is a path in the watch list.
+type watchEntry struct {
+	// Last time the path triggered the command
+	seen time.Time
+	// Last known state of the path and, if a directory, of its entries,
+	// with --check-mtime or --watch-mtime-only
+	files map[string]fileState
+	// Pattern matching no path yet the directory is watched for, by
+	// watchParent, in which case its own changes do not run the command
+	parentOf string
+	// The path is not watched by itself, but through its directory, with
+	// --dir-watch-only
+	viaDir bool
+	// Pattern, or path given with --files, the path was first matched by
+	pattern string
+}
+
+// seenAt returns the last time path triggered the command, and whether
+// it is being watched.
+func (w *Watcher) seenAt(path string) (time.Time, bool) {
+	w.listMu.Lock()
+	defer w.listMu.Unlock()
+	e, ok := w.list[normalizePath(path)]
+	if !ok {
+		return time.Time{}, false
+	}
+	return e.seen, true
+}
+
+// markSeen records t as the last time path triggered the command. Paths
+// removed from the watch list meanwhile, like deleted ones, are not added
+// back.
+func (w *Watcher) markSeen(path string, t time.Time) {
+	w.listMu.Lock()
+	defer w.listMu.Unlock()
+	if e, ok := w.list[normalizePath(path)]; ok {
+		e.seen = t
+	}
+}
+
+// recordStates records the current state of path, watched as key, and of
+// its entries if it is a directory, for --check-mtime and
+// --watch-mtime-only.
+func (w *Watcher) recordStates(key, path string) {
+	states := scan(path)
+	w.listMu.Lock()
+	defer w.listMu.Unlock()
+	e, ok := w.list[normalizePath(key)]
+	if !ok {
+		return
+	}
+	if e.files == nil {
+		e.files = make(map[string]fileState)
+	}
+	for p, st := range states {
+		e.files[p] = st
+	}
+}
+
+// contentChanged reports whether the modification time, size or mode of
+// path, watched as key, differ from the last known ones, and records
+// the current ones. Paths that can't be read, or with no known state,
+// are reported as changed.
+func (w *Watcher) contentChanged(key, path string) bool {
+	old, st, known := w.swapState(key, path)
+	return !known || !old.ModTime.Equal(st.ModTime) || old.Size != st.Size || old.Mode != st.Mode
+}
+
+// mtimeAdvanced reports whether the modification time of path, watched as
+// key, is later than the last known one, and records the current state,
+// for --watch-mtime-only. Paths that can't be read, like deleted ones, or
+// with no known state, like created ones, are reported as advanced.
+func (w *Watcher) mtimeAdvanced(key, path string) bool {
+	old, st, known := w.swapState(key, path)
+	return !known || st.ModTime.After(old.ModTime)
+}
+
+// swapState records the current state of path, watched as key, and
+// returns the last known one along with it. known is false if there is
+// none, or path can't be read.
+func (w *Watcher) swapState(key, path string) (old, st fileState, known bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return old, st, false
+	}
+	st = fileState{ModTime: info.ModTime(), Size: info.Size(), Mode: info.Mode()}
+	w.listMu.Lock()
+	defer w.listMu.Unlock()
+	e, ok := w.list[normalizePath(key)]
+	if !ok {
+		return old, st, false
+	}
+	if e.files == nil {
+		e.files = make(map[string]fileState)
+	}
+	old, known = e.files[path]
+	e.files[path] = st
+	return old, st, known
+}
+
+// addToList adds path to the watch list, unless already there, and
+// reports whether it was added.
+func (w *Watcher) addToList(path string, isDir bool) bool {
+	w.listMu.Lock()
+	defer w.listMu.Unlock()
+	path = normalizePath(path)
+	if isDir {
+		w.dirs[path] = true
+	}
+	if _, ok := w.list[path]; ok {
+		return false
+	}
+	// Never run for it, so that the very first change is not ignored
+	// however long the --min-interval is
+	w.list[path] = &watchEntry{}
+	return true
+}
+
+// removeFromList removes path from the watch list.
+func (w *Watcher) removeFromList(path string) {
+	w.listMu.Lock()
+	defer w.listMu.Unlock()
+	path = normalizePath(path)
+	if e, ok := w.list[path]; ok && e.viaDir {
+		w.viaDir--
+	}
+	delete(w.list, path)
+	delete(w.dirs, path)
+}
+
+// setViaDir marks path, in the watch list, as watched through its
+// directory.
+func (w *Watcher) setViaDir(path string) {
+	w.listMu.Lock()
+	defer w.listMu.Unlock()
+	if e, ok := w.list[normalizePath(path)]; ok && !e.viaDir {
+		e.viaDir = true
+		w.viaDir++
+	}
+}
+
+// removeTree removes path, and the paths below it if it is a directory,
+// from the watch list, and returns the removed entries.
+func (w *Watcher) removeTree(path string) map[string]*watchEntry {
+	w.listMu.Lock()
+	defer w.listMu.Unlock()
+	path = normalizePath(path)
+	prefix := path + string(filepath.Separator)
+	removed := make(map[string]*watchEntry)
+	for p, e := range w.list {
+		if p == path || strings.HasPrefix(p, prefix) {
+			if e.viaDir {
+				w.viaDir--
+			}
+			removed[p] = e
+			delete(w.list, p)
+			delete(w.dirs, p)
+		}
+	}
+	return removed
+}
+
+// forget stops watching path, deleted or renamed away, and the paths
+// below it, so that the watch list does not grow with dead paths over a
+// long session. If created again, it is watched again like any new path.
+// A watched directory renamed away is kept as moved, for followMove.
+func (w *Watcher) forget(path, op string) {
+	if _, err := os.Lstat(path); err == nil {
+		// Already replaced, like by an atomic save
+		return
+	}
+	isDir := w.isWatchedDir(path)
+	removed := w.removeTree(path)
+	for p := range removed {
+		w.tracef("%s is gone, removed from the watch list", p)
+		if err := w.source.Unwatch(p); err != nil {
+			w.tracef("Unable to stop watching %s: %v", p, err)
+		}
+	}
+	if op == "rename" && isDir {
+		w.moved = &movedTree{from: path, entries: removed, at: time.Now()}
+	}
+}
+
+// Type movedTree is a watched directory renamed away, with the watch list
+// entries of it and of the paths below it, until it shows up again.
+type movedTree struct {
+	from    string
+	entries map[string]*watchEntry
+	at      time.Time
+}
+
+// followMove handles dir, a new directory already watched, as the last
+// watched directory renamed away, if that happened right before, as the
+// rename and the create are delivered separately. The paths below it keep
+// the last time they triggered the command, and their last known state.
+func (w *Watcher) followMove(dir string) {
+	m := w.moved
+	if m == nil || time.Since(m.at) > atomicSaveWindow {
+		w.moved = nil
+		return
+	}
+	w.moved = nil
+	w.verbosef(2, "%s moved to %s, keeping its watches", m.from, dir)
+	rename := func(p string) string {
+		return dir + strings.TrimPrefix(p, m.from)
+	}
+	w.listMu.Lock()
+	defer w.listMu.Unlock()
+	for p, old := range m.entries {
+		e, ok := w.list[rename(p)]
+		if !ok {
+			continue
+		}
+		e.seen = old.seen
+		for f, st := range old.files {
+			if e.files == nil {
+				e.files = make(map[string]fileState)
+			}
+			e.files[rename(f)] = st
+		}
+	}
+}
+
+// watchedFor returns the pattern dir is only watched for by watchParent,
+// or an empty string.
+func (w *Watcher) watchedFor(dir string) string {
+	w.listMu.Lock()
+	defer w.listMu.Unlock()
+	if e, ok := w.list[normalizePath(dir)]; ok {
+		return e.parentOf
+	}
+	return ""
+}
+
+// setPattern records pattern as the one path, in the watch list, was
+// matched by, unless matched by another one before.
+func (w *Watcher) setPattern(path, pattern string) {
+	w.listMu.Lock()
+	defer w.listMu.Unlock()
+	if e, ok := w.list[normalizePath(path)]; ok && e.pattern == "" {
+		e.pattern = pattern
+	}
+}
+
+// patternOf returns the pattern that matched path or, for the paths
+// below a matched directory, the one that matched the closest of them.
+// It returns an empty string for paths not watched, as for runs at
+// startup.
+func (w *Watcher) patternOf(path string) string {
+	if path == "" {
+		return ""
+	}
+	w.listMu.Lock()
+	defer w.listMu.Unlock()
+	for p := normalizePath(path); ; {
+		if e, ok := w.list[p]; ok && e.pattern != "" {
+			return e.pattern
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return ""
+		}
+		p = parent
+	}
+}
+
+// watchCount returns the number of watched paths, not counting the ones
+// watched through their directory.
+func (w *Watcher) watchCount() int {
+	w.listMu.Lock()
+	defer w.listMu.Unlock()
+	return len(w.list) - w.viaDir
+}
+
+// isWatchedDir reports whether dir is watched for its own sake, so that
+// changes to its children trigger the command.
+func (w *Watcher) isWatchedDir(dir string) bool {
+	w.listMu.Lock()
+	defer w.listMu.Unlock()
+	return w.dirs[dir]
+}
+
+// Watch starts monitoring a file path. It also monitors the
+// directory for changes, so attribute changes are also visible.
+// With --dir-watch-only, a file is monitored through the directory only.
+// It returns errMaxWatches if --max-watches paths are watched already.
+func (w *Watcher) Watch(file string) error {
+	isDir := IsDir(file)
+	towatch := []string{file}
+	// Also monitors the directory, if file, so attrib changes
+	// and timestamp changes are visible as well.
+	if !isDir {
+		towatch = append(towatch, filepath.Dir(file))
+	}
+	viaDir := !isDir && w.opts.DirWatchOnly
+
+	for i, file := range towatch {
+		_, ok := w.seenAt(file)
+		if !ok && !(viaDir && i == 0) && w.opts.MaxWatches > 0 && w.watchCount() >= w.opts.MaxWatches {
+			if viaDir {
+				w.removeFromList(towatch[0])
+			}
+			return errMaxWatches
+		}
+		// Only the first path was asked for, the other is its parent
+		if !w.addToList(file, isDir && i == 0) {
+			w.verbosef(3, "Path %s already in watch list", file)
+			continue
+		}
+		var err error
+		if viaDir && i == 0 {
+			// Its directory, watched next, reports its changes
+			w.verbosef(3, "Watching [%s] through its directory", file)
+			w.setViaDir(file)
+		} else {
+			w.verbosef(3, "Watching [%s]", file)
+			err = w.source.Watch(file)
+		}
+		if err != nil {
+			w.removeFromList(file)
+			if viaDir {
+				w.removeFromList(towatch[0])
+			}
+			if errors.Is(err, syscall.ENOSPC) {
+				w.hintWatches()
+			}
+			return err
+		}
+		// The parent of a file is watched for changes to the file only
+		if (w.opts.CheckMtime || w.opts.WatchMtimeOnly) && i == 0 {
+			w.recordStates(file, file)
+		}
+		if w.watchCount() == watchesHint {
+			w.hintWatches()
+		}
+	}
+	return nil
+}
+
+// tryWatch watches path, and logs and skips it if that fails, so that
+// the other paths are still watched.
+func (w *Watcher) tryWatch(path string) {
+	err := w.Watch(path)
+	if err == errMaxWatches {
+		w.warnMaxWatches(path)
+	} else if err != nil {
+		warnf("watch", Fields{"path": path, "error": err.Error()}, "Unable to watch %s: %v", path, err)
+	}
+}
+
+// warnMaxWatches logs, once, that path and the next ones are skipped as
+// --max-watches paths are watched already.
+func (w *Watcher) warnMaxWatches(path string) {
+	if !w.maxWatchesWarned {
+		warnf("watch", Fields{"path": path}, "Watching %d paths already (--max-watches), skipping %s and the next ones", w.opts.MaxWatches, path)
+		w.maxWatchesWarned = true
+	}
+}
+
+// hintWatches logs, once, how to raise the inotify limit on the number
+// of watched paths.
+func (w *Watcher) hintWatches() {
+	if w.watchesHintLogged || w.opts.Poll > 0 {
+		return
+	}
+	w.watchesHintLogged = true
+	warnf("watch", Fields{"count": w.watchCount()}, "Watching %d paths. If changes are missed, raise the limit with "+
+		"'sysctl fs.inotify.max_user_watches=524288', or skip directories with --exclude", w.watchCount())
+}
+
+// WatchPatterns lookup all gob matches from patterns and watch them.
+// If -r/--recursive is true, walks all sub-trees recursivelly.
+func (w *Watcher) WatchPatterns(patterns []string) {
+	for _, p := range patterns {
+		if glob, err := Glob(p); err == nil {
+			for _, fname := range glob {
+				if !w.opts.WatchHidden && hiddenMatch(p, fname) {
+					w.verbosef(3, "Skipping [%s] (hidden)", fname)
+					continue
+				}
+				w.watchPath(fname)
+				w.setPattern(fname, p)
+			}
+			if len(glob) == 0 {
+				w.watchParent(p)
+			}
+		}
+	}
+}
+
+// watchParent watches the directory the paths matching pattern, which
+// matches none yet, would be created in, so that they are watched once
+// created. Only the entries of the directory are watched, and changes to
+// them that do not match the patterns do not run the command.
+func (w *Watcher) watchParent(pattern string) {
+	dir := patternDir(pattern)
+	if w.IsExcluded(dir, true) {
+		return
+	}
+	if _, ok := w.seenAt(dir); !ok && w.opts.MaxWatches > 0 && w.watchCount() >= w.opts.MaxWatches {
+		w.warnMaxWatches(dir)
+		return
+	}
+	if !w.addToList(dir, false) {
+		return
+	}
+	w.listMu.Lock()
+	w.list[dir].parentOf = pattern
+	w.listMu.Unlock()
+	w.verbosef(3, "Watching [%s] for paths matching %s", dir, pattern)
+	if err := w.source.Watch(dir); err != nil {
+		w.removeFromList(dir)
+		warnf("watch", Fields{"path": dir, "error": err.Error()}, "Unable to watch %s: %v", dir, err)
+	}
+}
+
+// WatchFiles watches the paths given with --files, as they are, without
+// expanding wildcards. Paths that do not exist are logged and skipped, and
+// watched once created.
+func (w *Watcher) WatchFiles(files []string) {
+	for _, f := range files {
+		if _, err := os.Lstat(f); err != nil {
+			warnf("watch", Fields{"path": f, "error": err.Error()}, "Not watching %s: %v", f, err)
+			continue
+		}
+		w.watchPath(f)
+		w.setPattern(f, f)
+	}
+}
+
+// isListedFile reports whether path was given with --files.
+func (w *Watcher) isListedFile(path string) bool {
+	for _, f := range w.opts.Files {
+		if normalizePath(f) == path {
+			return true
+		}
+	}
+	return false
+}
+
+// watchPath watches fname, unless excluded, and the directories below
+// it when recursive.
+func (w *Watcher) watchPath(fname string) {
+	if w.IsExcluded(fname, IsDir(fname)) {
+		return
+	}
+	w.tryWatch(fname)
+	if w.opts.Recursive {
+		subdirs := w.SubDirs
+		// The saved state has no links, and they are
+		// always walked again
+		if w.state != nil && !w.opts.FollowSymlinks {
+			subdirs = w.WalkDirs
+		}
+		for _, s := range subdirs(fname) {
+			w.tryWatch(s)
+		}
+	}
+}
+
+// SubsumePatterns returns patterns without the duplicates, and without
+// the paths inside directories given by other patterns, as they are
+// watched already when recursive. Paths inside excluded directories are
+// kept, as the walk of the parent skips them. Patterns with wildcards
+// are always kept.
+func (w *Watcher) SubsumePatterns(patterns []string) []string {
+	var dirs []string
+	for _, p := range patterns {
+		if !hasMeta(p) && IsDir(p) {
+			dirs = append(dirs, normalizePath(p))
+		}
+	}
+	var kept []string
+	seen := make(map[string]bool)
+	for _, p := range patterns {
+		clean := normalizePath(p)
+		if seen[clean] {
+			w.verbosef(1, "Pattern %s given more than once", p)
+			continue
+		}
+		seen[clean] = true
+		if hasMeta(p) {
+			kept = append(kept, p)
+			continue
+		}
+		if dir, ok := w.parentPattern(clean, dirs); ok {
+			w.verbosef(1, "Pattern %s is inside %s, already watched recursively", p, dir)
+			continue
+		}
+		kept = append(kept, p)
+	}
+	return kept
+}
+
+// parentPattern returns the directory in dirs that path is inside of, if
+// any, and not excluded on the way down to path.
+func (w *Watcher) parentPattern(path string, dirs []string) (string, bool) {
+	for _, dir := range dirs {
+		var inside bool
+		if dir == "." {
+			inside = path != "." && !filepath.IsAbs(path) && !strings.HasPrefix(path, "..")
+		} else {
+			inside = strings.HasPrefix(path, dir+string(filepath.Separator))
+		}
+		if !inside {
+			continue
+		}
+		excluded := false
+		for d := path; d != dir && d != "."; d = filepath.Dir(d) {
+			if w.IsExcluded(d, true) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+// Func HandleEvent monitors for changes, executes the specified command
+// and keep monitoring for new folders when added. It reports whether the
+// event triggered the command, and the error it returned, if any.
+func (w *Watcher) HandleEvent(ev Event) (bool, error) {
+	defer func() {
+		w.runMu.Lock()
+		w.handled = time.Now()
+		w.runMu.Unlock()
+	}()
+	w.status.mu.Lock()
+	w.status.events++
+	w.status.mu.Unlock()
+	created := ev.Op == "create"
+	if w.opts.CoalesceSaves {
+		var ok bool
+		if ev, ok = w.coalesce(ev); !ok {
+			return false, nil
+		}
+	}
+	path := normalizePath(ev.Name)
+	// Before watching it, if created
+	_, known := w.seenAt(path)
+	// Also for a file replaced by an atomic save, which is a new file
+	// to watch, even if handled as a write
+	if created {
+		if w.opts.Recursive && IsDir(path) && w.InWatchedTree(path) && !w.IsExcluded(path, true) && !w.isHidden(path) {
+			// New directory, watch it and everything below it, as
+			// it may not match the patterns by itself
+			for _, s := range w.SubDirs(path) {
+				w.tryWatch(s)
+			}
+		}
+		// New file added, check if it matches the patterns
+		w.WatchPatterns(w.opts.Patterns)
+		if w.isListedFile(path) {
+			w.watchPath(path)
+			w.setPattern(path, path)
+		}
+		if w.moved != nil && IsDir(path) {
+			w.followMove(path)
+		}
+		// Otherwise, the creation of a matching file runs the command
+		// right away, like a write, without waiting for the next one
+		if ev.Op == "create" && !w.opts.Events.Has("create") {
+			return false, nil
+		}
+	}
+	if ev.Op == "delete" || ev.Op == "rename" {
+		// Once handled, as it may be debounced by itself
+		defer w.forget(path, ev.Op)
+	}
+	if w.opts.ResetFile != "" && samePath(path, w.opts.ResetFile) {
+		w.Resume(fmt.Sprintf("%s changed", path))
+		return false, nil
+	}
+	if w.opts.CommandFile != "" && !w.opts.WatchCommandFile && samePath(path, w.opts.CommandFile) {
+		w.verbosef(2, "Ignoring event %s on the command file", ev)
+		return false, nil
+	}
+	if w.opts.IgnoreDuringRun && w.duringRun() {
+		w.tracef("%s changed while the command ran, ignored", path)
+		return false, nil
+	}
+
+	// Changes to files inside watched directories are debounced
+	// along with the directory itself
+	key := path
+	if _, ok := w.seenAt(path); !ok && w.isWatchedDir(filepath.Dir(path)) {
+		if w.IsExcluded(path, false) {
+			w.tracef("%s is excluded", path)
+			return false, nil
+		}
+		if w.isHidden(path) {
+			w.verbosef(2, "Ignoring event %s (hidden, watched with --watch-hidden)", ev)
+			return false, nil
+		}
+		key = filepath.Dir(path)
+	}
+
+	now := time.Now()
+	wtime, watching := w.seenAt(key)
+	if !watching {
+		w.tracef("%s is not in the watch list", path)
+		return false, nil
+	}
+	if wtime.IsZero() {
+		w.tracef("%s is in the watch list as %s, never run", path, key)
+	} else {
+		w.tracef("%s is in the watch list as %s, last run %s ago", path, key, now.Sub(wtime).Round(time.Millisecond))
+	}
+	if key == path && w.watchedFor(path) != "" {
+		w.tracef("%s is only watched for paths matching %s", path, w.watchedFor(path))
+		return false, nil
+	}
+	if !w.opts.Events.Match(ev) {
+		w.verbosef(2, "Ignoring event %s", ev)
+		return false, nil
+	}
+	if w.opts.WatchNewOnly && (ev.Op != "create" || known) {
+		w.verbosef(2, "Ignoring event %s (not a new path, watching new paths only)", ev)
+		return false, nil
+	}
+	if !w.IsIncluded(path) {
+		w.verbosef(2, "Ignoring event %s (not matched by --include)", ev)
+		return false, nil
+	}
+	if w.opts.WatchMtimeOnly {
+		if !w.mtimeAdvanced(key, path) {
+			w.verbosef(2, "Ignoring event %s (modification time did not advance)", ev)
+			return false, nil
+		}
+	} else if w.opts.CheckMtime && (ev.Op == "write" || ev.Op == "attrib") && !w.contentChanged(key, path) {
+		w.verbosef(2, "Ignoring event %s (modification time, size and mode did not change)", ev)
+		return false, nil
+	}
+	if !w.sizeInRange(path) {
+		w.verbosef(2, "Ignoring event %s (size not within --min-size and --max-size)", ev)
+		return false, nil
+	}
+	minInterval, settle := w.delaysFor(path)
+	if !w.opts.Batch {
+		w.runMu.Lock()
+		storm := w.inStorm(path, ev.Op, settle)
+		w.runMu.Unlock()
+		if storm {
+			w.tracef("%s changed during a bulk operation, waiting for it to settle", path)
+			return false, nil
+		}
+	}
+	if w.opts.Batch {
+		w.debugf(1, "change", Fields{"path": path, "type": ev.Op}, "%s changed (%s), waiting %s for more changes", path, ev, settle)
+		w.runMu.Lock()
+		w.addToBatch(path, ev.Op, settle+w.jitter())
+		w.runMu.Unlock()
+		return false, nil
+	}
+	if w.opts.Debounce == debounceTrailing && settle > 0 {
+		w.debugf(1, "change", Fields{"path": path, "type": ev.Op}, "%s changed (%s), waiting %s for more changes", path, ev, settle)
+		w.runMu.Lock()
+		w.addPending(key, path, ev.Op, settle+w.jitter())
+		w.runMu.Unlock()
+		return false, nil
+	}
+	// Without a minimum interval, there is nothing to debounce, and the
+	// commands debounce the changes themselves with --debounce-per-command
+	if minInterval > 0 && now.Sub(wtime) < minInterval && !w.opts.DebouncePerCommand {
+		w.tracef("%s did not pass the debounce of %s", path, minInterval)
+		w.ignoreFast(path)
+		return false, nil
+	}
+	w.tracef("%s passed the debounce of %s", path, minInterval)
+
+	w.debugf(1, "change", Fields{"path": path, "type": ev.Op}, "%s changed (%s)", path, ev)
+	if w.opts.Jitter > 0 {
+		// Run once the jitter passed, again if changed meanwhile
+		wait := w.jitter()
+		w.tracef("Waiting %s of jitter before running for %s", wait.Round(time.Millisecond), path)
+		w.runMu.Lock()
+		w.addPending(key, path, ev.Op, wait)
+		w.runMu.Unlock()
+		return false, nil
+	}
+	if minInterval > 0 {
+		// Wait for stormWindow before running, so that the first changes
+		// of a bulk operation are collected with the next ones instead.
+		// Without a delay, every change runs the command right away.
+		w.runMu.Lock()
+		if _, held := w.pending[key]; held {
+			w.pending[key] = pendingChange{path: path, event: ev.Op}
+		} else {
+			w.addPending(key, path, ev.Op, stormWindow)
+		}
+		w.runMu.Unlock()
+		return false, nil
+	}
+	w.markSeen(key, now)
+	w.runMu.Lock()
+	defer w.runMu.Unlock()
+	return w.execute(path, ev.Op, nil)
+}
+
+// RunOnStart runs the command once, before any change happened. There
+// is no changed path, so WHENCHANGE_PATH and the placeholders are empty.
+func (w *Watcher) RunOnStart() (bool, error) {
+	w.runMu.Lock()
+	defer w.runMu.Unlock()
+	return w.execute("", "startup", nil)
+}
+
+// addToBatch records path as the most recent change, and restarts the
+// quiet period before the batch runs, of settle. Must be called with
+// runMu held.
+func (w *Watcher) addToBatch(path, event string, settle time.Duration) {
+	for i, p := range w.batch {
+		if p == path {
+			w.batch = append(w.batch[:i], w.batch[i+1:]...)
+			break
+		}
+	}
+	w.batch = append(w.batch, path)
+	w.batchEvent = event
+	w.batchTimer.Reset(settle)
+}
+
+// FlushBatch runs the command once for all paths changed since the last
+// run, in --batch mode, or during a bulk operation. The most recent change
+// is used to expand the placeholders and for WHENCHANGE_PATH and
+// WHENCHANGE_EVENT. With --group-by-dir, the command runs once for each
+// directory instead, one after the other, with the files changed in it.
+func (w *Watcher) FlushBatch() (bool, error) {
+	w.runMu.Lock()
+	defer w.runMu.Unlock()
+	if len(w.batch) == 0 {
+		return false, nil
+	}
+	if wait := w.opts.MinInterval - time.Since(w.batchRun); wait > 0 {
+		w.verbosef(1, "Last run %s ago, waiting %s more", time.Since(w.batchRun).Round(time.Millisecond), wait.Round(time.Millisecond))
+		w.batchTimer.Reset(wait)
+		return false, nil
+	}
+	files := w.batch
+	w.batch = nil
+	w.batchRun = time.Now()
+	w.storming = false
+	w.verbosef(1, "%d files changed: %v", len(files), files)
+	return w.executeBatch(files, w.batchEvent)
+}
+
+// executeBatch runs the command once for files, changed by event, or
+// once for each of their directories with --group-by-dir. Must be called
+// with runMu held.
+func (w *Watcher) executeBatch(files []string, event string) (bool, error) {
+	if !w.opts.GroupByDir {
+		return w.execute(files[len(files)-1], event, files)
+	}
+	dirs, groups := splitByDir(files)
+	w.verbosef(1, "Running for %d directories: %v", len(dirs), dirs)
+	ran := false
+	var err error
+	for _, dir := range dirs {
+		group := groups[dir]
+		if r, e := w.execute(group[len(group)-1], event, group); r {
+			ran, err = true, e
+		}
+	}
+	return ran, err
+}
+
+// splitByDir returns the directories of files, in the order they first
+// changed, and the files changed in each one, for --group-by-dir.
+func splitByDir(files []string) ([]string, map[string][]string) {
+	var dirs []string
+	groups := make(map[string][]string)
+	for _, f := range files {
+		dir := filepath.Dir(f)
+		if _, ok := groups[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+		groups[dir] = append(groups[dir], f)
+	}
+	return dirs, groups
+}
+
+// Type pendingChange is the last change to a watched path, waiting for
+// the quiet period in --debounce=trailing mode.
+type pendingChange struct {
+	path  string
+	event string
+}
+
+// addPending records the change to path, watched as key, and restarts
+// the quiet period before the command runs for it, of settle. Must be
+// called with runMu held.
+func (w *Watcher) addPending(key, path, event string, settle time.Duration) {
+	w.pending[key] = pendingChange{path: path, event: event}
+	if t, ok := w.timers[key]; ok {
+		t.Reset(settle)
+		return
+	}
+	w.timers[key] = time.AfterFunc(settle, func() {
+		select {
+		case w.fire <- key:
+		case <-w.quit:
+		}
+	})
+}
+
+// ignoreFast counts a change to path ignored for being too fast, to log
+// it in the next summary.
+func (w *Watcher) ignoreFast(path string) {
+	if w.opts.Verbosity < 1 {
+		return
+	}
+	if len(w.ignored) == 0 {
+		w.ignoredTimer.Reset(ignoredSummaryInterval)
+	}
+	w.ignored[path]++
+}
+
+// Heartbeat logs that the paths are still watched, and for how long no
+// change arrived, with --heartbeat.
+func (w *Watcher) Heartbeat() {
+	w.runMu.Lock()
+	idle := time.Since(w.handled).Round(time.Second)
+	w.runMu.Unlock()
+	count := w.watchCount()
+	infof("heartbeat", Fields{"count": count, "idle": idle.Seconds()}, "Still watching %d paths, idle for %s", count, idle)
+}
+
+// FlushIgnored logs how many changes to each path were ignored for being
+// too fast since the last summary.
+func (w *Watcher) FlushIgnored() {
+	paths := make([]string, 0, len(w.ignored))
+	for p := range w.ignored {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		n := w.ignored[p]
+		changes := "changes"
+		if n == 1 {
+			changes = "change"
+		}
+		w.debugf(1, "ignored", Fields{"path": p, "count": n}, "Ignored %d rapid %s to %s in the last %s", n, changes, p, ignoredSummaryInterval)
+		delete(w.ignored, p)
+	}
+}
+
+// FlushPending runs the command for the last change to key, once no
+// change arrived for the delay, in --debounce=trailing mode, or once the
+// --jitter, or stormWindow in --debounce=leading mode, passed.
+func (w *Watcher) FlushPending(key string) (bool, error) {
+	w.runMu.Lock()
+	defer w.runMu.Unlock()
+	ch, ok := w.pending[key]
+	if !ok {
+		// Already run, by a timer that fired while being reset
+		return false, nil
+	}
+	minInterval, _ := w.delaysFor(ch.path)
+	if wtime, _ := w.seenAt(key); time.Since(wtime) < minInterval {
+		wait := minInterval - time.Since(wtime)
+		w.verbosef(1, "Last run for %s %s ago, waiting %s more", key, time.Since(wtime).Round(time.Millisecond), wait.Round(time.Millisecond))
+		w.timers[key].Reset(wait)
+		return false, nil
+	}
+	delete(w.pending, key)
+	delete(w.timers, key)
+	w.markSeen(key, time.Now())
+	return w.execute(ch.path, ch.event, nil)
+}
+
+// samePath reports whether a and b are the same path, once absolute.
+func samePath(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+// normalizePath returns path cleaned, and with the separator of the
+// system, so that patterns given with forward slashes on Windows match
+// the names of the events and the keys of the watch list.
+func normalizePath(path string) string {
+	return filepath.Clean(filepath.FromSlash(path))
+}
+
+func IsDir(path string) bool {
+	s, err := os.Stat(path)
+	if err != nil {
+		errorf("stat", Fields{"path": path, "error": err.Error()}, "Unable to stat %s: %v", path, err)
+		return false
+	}
+	return s.IsDir()
+}
+
+// HandleError logs an error from the event source, and schedules all
+// the paths to be watched again, in case the error dropped some of them.
+// If errors keep arriving, the delay before watching them again doubles
+// each time, up to maxRewatchDelay.
+func (w *Watcher) HandleError(err error) {
+	errorf("error", Fields{"error": err.Error()}, "%s", err)
+	if w.rewatchScheduled {
+		return
+	}
+	if w.rewatchDelay == 0 || time.Since(w.rewatched) > maxRewatchDelay {
+		w.rewatchDelay = minRewatchDelay
+	} else if w.rewatchDelay *= 2; w.rewatchDelay > maxRewatchDelay {
+		w.rewatchDelay = maxRewatchDelay
+	}
+	w.verbosef(1, "Watching all paths again in %s", w.rewatchDelay)
+	w.rewatchScheduled = true
+	w.rewatchTimer.Reset(w.rewatchDelay)
+}
+
+// Rewatch watches again all the paths matched by the patterns, keeping
+// the time each one last triggered the command.
+func (w *Watcher) Rewatch() {
+	w.rewatchScheduled = false
+	w.rewatched = time.Now()
+	w.watchAgain()
+	count := w.watchCount()
+	infof("rewatch", Fields{"count": count}, "Watching %d paths again", count)
+}
+
+// watchAgain builds the watch list again, with the paths matched by the
+// patterns, keeping the time each one last triggered the command, and
+// returns the previous one.
+func (w *Watcher) watchAgain() map[string]*watchEntry {
+	w.listMu.Lock()
+	seen := w.list
+	w.list = make(map[string]*watchEntry)
+	w.dirs = make(map[string]bool)
+	w.viaDir = 0
+	w.listMu.Unlock()
+
+	w.WatchPatterns(w.opts.Patterns)
+	w.WatchFiles(w.opts.Files)
+
+	w.listMu.Lock()
+	defer w.listMu.Unlock()
+	for p, old := range seen {
+		if e, ok := w.list[p]; ok {
+			e.seen = old.seen
+		}
+	}
+	return seen
+}
+
+// InWatchedTree reports whether path is below one of the directories
+// matched by the patterns, and so is watched when recursive.
+func (w *Watcher) InWatchedTree(path string) bool {
+	path = normalizePath(path)
+	for _, p := range w.opts.Patterns {
+		glob, err := Glob(p)
+		if err != nil {
+			continue
+		}
+		for _, dir := range glob {
+			dir = normalizePath(dir)
+			if dir == path || !IsDir(dir) {
+				continue
+			}
+			if dir == "." && !filepath.IsAbs(path) && !strings.HasPrefix(path, "..") {
+				return true
+			}
+			if strings.HasPrefix(path, dir+string(filepath.Separator)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Given a file path, all sub directories are returned. With
+// --follow-symlinks, the targets of links to directories are walked too.
+// Directories that can't be read are logged and skipped.
+func (w *Watcher) SubDirs(path string) []string {
+	var paths []string
+	visited := make(map[dirKey]bool)
+	var walk func(root string)
+	walk = func(root string) {
+		filepath.Walk(root, func(newPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				// Skip the directories that can't be read, and keep
+				// walking the others
+				if n := len(paths); n > 0 && paths[n-1] == newPath {
+					paths = paths[:n-1]
+				}
+				warnf("watch", Fields{"path": newPath, "error": err.Error()}, "Unable to watch %s: %v", newPath, err)
+				return nil
+			}
+			if w.opts.FollowSymlinks && info.Mode()&os.ModeSymlink != 0 {
+				if target, ok := w.followLink(newPath, visited); ok {
+					walk(target)
+				}
+				return nil
+			}
+			// The root was asked for, even if hidden
+			if w.IsExcluded(newPath, info.IsDir()) || (newPath != root && w.isHidden(newPath)) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.IsDir() {
+				if w.opts.FollowSymlinks && !visit(visited, newPath, info) {
+					return filepath.SkipDir
+				}
+				paths = append(paths, newPath)
+				if w.opts.Gitignore {
+					w.LoadGitignore(newPath)
+				}
+			}
+			return nil
+		})
+	}
+	walk(path)
+	return paths
+}
+
+// followLink returns the target of link, if it is a directory that was
+// not visited yet. Directories are identified by their device and inode,
+// and not by path, so that links to a parent directory, or to the home
+// directory while watching it, are only walked once instead of looping
+// forever.
+func (w *Watcher) followLink(link string, visited map[dirKey]bool) (string, bool) {
+	if w.IsExcluded(link, true) || w.isHidden(link) {
+		return "", false
+	}
+	target, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		w.verbosef(3, "Skipping [%s] (broken link: %v)", link, err)
+		return "", false
+	}
+	info, err := os.Stat(target)
+	if err != nil || !info.IsDir() {
+		return "", false
+	}
+	if visited[dirKeyOf(target, info)] {
+		w.verbosef(3, "Skipping [%s] (links to %s, already watched)", link, target)
+		return "", false
+	}
+	w.verbosef(3, "Following [%s] to %s", link, target)
+	return target, true
+}
+
+// visit records the directory at path, with info, as visited, and reports
+// whether it was not visited before.
+func visit(visited map[dirKey]bool, path string, info os.FileInfo) bool {
+	k := dirKeyOf(path, info)
+	if visited[k] {
+		return false
+	}
+	visited[k] = true
+	return true
+}
+
+// IsIncluded reports whether a change to path triggers the command: if
+// any include patterns are given, path must match one of them. Like the
+// exclude patterns, they are matched against both the base name and the
+// cleaned path.
+//
+// Patterns starting with ! are negated, and exclude the paths they match.
+// As in .gitignore files, the last pattern that matches path decides, and
+// paths matching none are included only if the first pattern is negated.
+func (w *Watcher) IsIncluded(path string) bool {
+	if len(w.opts.Include) == 0 {
+		return true
+	}
+	clean := normalizePath(path)
+	included := strings.HasPrefix(w.opts.Include[0], "!")
+	for _, p := range w.opts.Include {
+		negated := strings.HasPrefix(p, "!")
+		p = normalizePath(strings.TrimPrefix(p, "!"))
+		for _, name := range []string{filepath.Base(clean), clean} {
+			if ok, _ := filepath.Match(p, name); ok {
+				included = !negated
+				break
+			}
+		}
+	}
+	return included
+}
+
+// isHidden reports whether path is hidden, and so skipped, unless
+// --watch-hidden is given.
+func (w *Watcher) isHidden(path string) bool {
+	return !w.opts.WatchHidden && isHidden(path)
+}
+
+// IsExcluded reports whether path matches any of the exclude patterns,
+// or is ignored by a .gitignore file when --gitignore is set.
+// Patterns are matched against both the base name and the cleaned path,
+// so that both "*.tmp" and "./src/vendor" work as expected.
+func (w *Watcher) IsExcluded(path string, isDir bool) bool {
+	clean := normalizePath(path)
+	base := filepath.Base(clean)
+	for _, p := range w.opts.Exclude {
+		for _, name := range []string{base, clean} {
+			if ok, _ := filepath.Match(normalizePath(p), name); ok {
+				w.verbosef(3, "Skipping [%s] (matched exclude %q)", path, p)
+				return true
+			}
+		}
+	}
+	// git never tracks its own metadata directory
+	if w.opts.Gitignore && (base == ".git" || w.gitignoreRules.Match(path, isDir)) {
+		w.verbosef(3, "Skipping [%s] (matched .gitignore)", path)
+		return true
+	}
+	return false
+}
+
+// verbosef logs a verbose message if the verbosity is at least level.
+func (w *Watcher) verbosef(level int, f string, args ...interface{}) {
+	w.debugf(level, "", nil, f, args...)
+}
+
+// tracef logs a message about the handling of each event, with --trace.
+func (w *Watcher) tracef(f string, args ...interface{}) {
+	if w.opts.Trace {
+		logger.Log("trace", "trace", nil, f, args...)
+	}
+}
+
+// debugf logs a verbose message about event, with its details in fields,
+// if the verbosity is at least level. The level is added to the fields.
+func (w *Watcher) debugf(level int, event string, fields Fields, f string, args ...interface{}) {
+	if w.opts.Verbosity < level {
+		return
+	}
+	tagged := Fields{"verbosity": level}
+	for k, v := range fields {
+		tagged[k] = v
+	}
+	logger.Log("debug", event, tagged, f, args...)
+}
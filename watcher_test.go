@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Time to wait for a condition before giving up, and to wait for the
+// commands that should not run.
+const (
+	testTimeout = 5 * time.Second
+	testQuiet   = 200 * time.Millisecond
+)
+
+// Type recorder records the commands run through execCommand.
+type recorder struct {
+	mu   sync.Mutex
+	runs [][]string
+}
+
+// recordCommands replaces execCommand with one that records the commands
+// before running them, until the test ends.
+func recordCommands(t *testing.T) *recorder {
+	t.Helper()
+	r := &recorder{}
+	orig := execCommand
+	execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		r.mu.Lock()
+		r.runs = append(r.runs, append([]string{name}, args...))
+		r.mu.Unlock()
+		return orig(ctx, name, args...)
+	}
+	t.Cleanup(func() { execCommand = orig })
+	return r
+}
+
+// count returns the number of commands run.
+func (r *recorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.runs)
+}
+
+// ran reports whether a command with an argument containing s was run.
+func (r *recorder) ran(s string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, run := range r.runs {
+		for _, arg := range run {
+			if strings.Contains(arg, s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Type lockedBuffer is a bytes.Buffer safe to write from the commands
+// and read from the test at the same time.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog collects the text messages logged until the test ends.
+func captureLog(t *testing.T) *lockedBuffer {
+	t.Helper()
+	b := &lockedBuffer{}
+	log.SetOutput(b)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return b
+}
+
+// waitFor fails the test unless cond is met within testTimeout.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitRuns waits for r to record n commands, and checks that no more are
+// run after that.
+func waitRuns(t *testing.T, r *recorder, n int) {
+	t.Helper()
+	waitFor(t, "the command to run", func() bool { return r.count() >= n })
+	time.Sleep(testQuiet)
+	if got := r.count(); got != n {
+		t.Errorf("Command run %d times, expected %d", got, n)
+	}
+}
+
+// testOptions returns the options to run true with sh when the paths
+// matching patterns change, without delays.
+func testOptions(patterns ...string) Options {
+	return Options{
+		Patterns: patterns,
+		Command:  []string{"true"},
+		Shell:    "sh",
+	}
+}
+
+// startRun calls Run with opts, getting the changes from a MemorySource,
+// until the test ends. It returns the source once ready is watched.
+func startRun(t *testing.T, opts Options, ready string) *MemorySource {
+	t.Helper()
+	src := NewMemorySource()
+	opts.Source = src
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- Run(ctx, opts) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	waitFor(t, "watching "+ready, func() bool { return src.Watched(ready) })
+	return src
+}
+
+// newTestWatcher returns a Watcher for opts, with a MemorySource, to try
+// its methods without calling Run.
+func newTestWatcher(t *testing.T, opts Options, source EventSource) *Watcher {
+	t.Helper()
+	opts.setDefaults()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return newWatcher(ctx, opts, source)
+}
+
+// chdirTemp changes to a new temporary directory until the test ends,
+// and returns it.
+func chdirTemp(t *testing.T) string {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+// writeFile creates, or writes to, the file at path.
+func writeFile(t *testing.T, path string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(time.Now().String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunMemorySource(t *testing.T) {
+	captureLog(t)
+	r := recordCommands(t)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.txt")
+	writeFile(t, file)
+
+	opts := testOptions(filepath.Join(dir, "*.txt"))
+	opts.Command = []string{"true", "{{.Path}}"}
+	src := startRun(t, opts, file)
+	if !src.Send(file, "write") {
+		t.Fatalf("Event on %s not delivered", file)
+	}
+	waitRuns(t, r, 1)
+	if !r.ran(file) {
+		t.Errorf("Command not run for %s: %v", file, r.runs)
+	}
+	if src.Send(filepath.Join(t.TempDir(), "b.txt"), "write") {
+		t.Errorf("Event delivered for a path not watched")
+	}
+}
+
+// Type countingSource is a MemorySource that counts the watches added for
+// each path.
+type countingSource struct {
+	*MemorySource
+	mu      sync.Mutex
+	watches map[string]int
+}
+
+func newCountingSource() *countingSource {
+	return &countingSource{MemorySource: NewMemorySource(), watches: make(map[string]int)}
+}
+
+func (s *countingSource) Watch(path string) error {
+	s.mu.Lock()
+	s.watches[normalizePath(path)]++
+	s.mu.Unlock()
+	return s.MemorySource.Watch(path)
+}
+
+func TestWatchParentOnce(t *testing.T) {
+	captureLog(t)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.txt")
+	writeFile(t, file)
+
+	src := newCountingSource()
+	w := newTestWatcher(t, testOptions(), src)
+	for i := 0; i < 2; i++ {
+		if err := w.Watch(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The pattern does not match yet, and is watched through dir too
+	w.watchParent(filepath.Join(dir, "*.log"))
+
+	if len(w.list) != 2 {
+		t.Errorf("Watch list has %d paths, expected %s and %s: %v", len(w.list), file, dir, w.list)
+	}
+	for _, p := range []string{file, dir} {
+		if _, ok := w.seenAt(p); !ok {
+			t.Errorf("Path %s not in the watch list", p)
+		}
+		if n := src.watches[p]; n != 1 {
+			t.Errorf("Path %s watched %d times, expected once", p, n)
+		}
+	}
+}
+
+func TestRunNewNestedDir(t *testing.T) {
+	captureLog(t)
+	r := recordCommands(t)
+	dir := t.TempDir()
+
+	opts := testOptions(dir)
+	opts.Recursive = true
+	opts.Command = []string{"true", "{{.Path}}"}
+	src := startRun(t, opts, dir)
+
+	deep := filepath.Join(dir, "a", "b", "c")
+	if err := os.MkdirAll(deep, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Only the top one is reported, the others are created with it
+	src.Send(filepath.Join(dir, "a"), "create")
+	file := filepath.Join(deep, "f.txt")
+	waitFor(t, "watching "+deep, func() bool { return src.Watched(file) })
+
+	writeFile(t, file)
+	if !src.Send(file, "write") {
+		t.Fatalf("Event on %s not delivered", file)
+	}
+	waitFor(t, "the command to run for "+file, func() bool { return r.ran(file) })
+}
+
+func TestRunUnreadableDir(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("Directories are always readable by root")
+	}
+	logs := captureLog(t)
+	r := recordCommands(t)
+	dir := t.TempDir()
+	locked, open := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	for _, d := range []string{locked, open} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(locked, 0755) })
+
+	opts := testOptions(dir)
+	opts.Recursive = true
+	file := filepath.Join(open, "f.txt")
+	src := startRun(t, opts, file)
+	if !strings.Contains(logs.String(), "Unable to watch "+locked) {
+		t.Errorf("No warning about %s logged:\n%s", locked, logs)
+	}
+	writeFile(t, file)
+	if !src.Send(file, "create") {
+		t.Fatalf("Event on %s not delivered", file)
+	}
+	waitRuns(t, r, 1)
+}
+
+func TestRunNoDelay(t *testing.T) {
+	captureLog(t)
+	r := recordCommands(t)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.txt")
+	writeFile(t, file)
+
+	src := startRun(t, testOptions(file), file)
+	for i := 0; i < 2; i++ {
+		if !src.Send(file, "write") {
+			t.Fatalf("Event on %s not delivered", file)
+		}
+	}
+	waitRuns(t, r, 2)
+}
+
+func TestBackslashPaths(t *testing.T) {
+	// Backslashes only separate paths on Windows, elsewhere they are
+	// part of the name
+	windows := runtime.GOOS == "windows"
+	w := newTestWatcher(t, Options{Include: []string{"src/*.go"}}, NewMemorySource())
+	for _, tc := range []struct {
+		path     string
+		included bool
+	}{
+		{"src/a.go", true},
+		{"./src//a.go", true},
+		{`src\a.go`, windows},
+		{`.\src\a.go`, windows},
+		{`src\sub\a.go`, false},
+		{"src/a.txt", false},
+	} {
+		if got := w.IsIncluded(tc.path); got != tc.included {
+			t.Errorf("IsIncluded(%q) = %v, expected %v", tc.path, got, tc.included)
+		}
+		// The paths included are the ones listed as src/a.go
+		if same := normalizePath(tc.path) == normalizePath("src/a.go"); same != tc.included {
+			t.Errorf("normalizePath(%q) = %q, same as src/a.go: %v, expected %v", tc.path, normalizePath(tc.path), same, tc.included)
+		}
+	}
+}
+
+func TestBackslashEvent(t *testing.T) {
+	captureLog(t)
+	r := recordCommands(t)
+	chdirTemp(t)
+	if err := os.Mkdir("src", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, "src/a.go")
+
+	windows := runtime.GOOS == "windows"
+	w := newTestWatcher(t, testOptions("src/*.go"), NewMemorySource())
+	w.WatchPatterns(w.opts.Patterns)
+	if _, ok := w.seenAt("src"); !ok {
+		t.Errorf("Parent directory src not in the watch list: %v", w.list)
+	}
+	if _, ok := w.seenAt(`src\a.go`); ok != windows {
+		t.Errorf("Path src\\a.go in the watch list: %v, expected %v", ok, windows)
+	}
+	w.HandleEvent(Event{Name: `src\a.go`, Op: "write"})
+	if ran := r.count() == 1; ran != windows {
+		t.Errorf("Command run for src\\a.go: %v, expected %v", ran, windows)
+	}
+}
+
+func TestDeletedFileLeavesList(t *testing.T) {
+	captureLog(t)
+	recordCommands(t)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.txt")
+	writeFile(t, file)
+
+	w := newTestWatcher(t, testOptions(file), NewMemorySource())
+	w.WatchPatterns(w.opts.Patterns)
+	if _, ok := w.seenAt(file); !ok {
+		t.Fatalf("Path %s not in the watch list", file)
+	}
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	w.HandleEvent(Event{Name: file, Op: "delete"})
+	if _, ok := w.seenAt(file); ok {
+		t.Errorf("Path %s still in the watch list once deleted", file)
+	}
+	writeFile(t, file)
+	w.HandleEvent(Event{Name: file, Op: "create"})
+	if _, ok := w.seenAt(file); !ok {
+		t.Errorf("Path %s not in the watch list once created again", file)
+	}
+}
+
+func TestRunFirstEventWithDelay(t *testing.T) {
+	captureLog(t)
+	r := recordCommands(t)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.txt")
+	writeFile(t, file)
+
+	opts := testOptions(file)
+	opts.MinInterval = 10 * time.Second
+	src := startRun(t, opts, file)
+	// The first change runs the command, the next is too soon
+	for i := 0; i < 2; i++ {
+		if !src.Send(file, "write") {
+			t.Fatalf("Event on %s not delivered", file)
+		}
+	}
+	waitRuns(t, r, 1)
+}
+
+func TestIncludeOverlapping(t *testing.T) {
+	for _, tc := range []struct {
+		include []string
+		path    string
+		want    bool
+	}{
+		{[]string{"*.go", "!*_test.go"}, "a.go", true},
+		{[]string{"*.go", "!*_test.go"}, "a_test.go", false},
+		// The last pattern that matches decides
+		{[]string{"!*_test.go", "*.go"}, "a_test.go", true},
+		{[]string{"*.go", "!*_test.go", "a_*.go"}, "a_test.go", true},
+		// Without a match, included only if the first one is negated
+		{[]string{"!*_test.go"}, "a.go", true},
+		{[]string{"*.go", "!*_test.go"}, "a.txt", false},
+	} {
+		w := newTestWatcher(t, Options{Include: tc.include}, NewMemorySource())
+		if got := w.IsIncluded(tc.path); got != tc.want {
+			t.Errorf("IsIncluded(%q) with %q = %v, expected %v", tc.path, tc.include, got, tc.want)
+		}
+	}
+}
+
+func TestRunIncludeOverlapping(t *testing.T) {
+	captureLog(t)
+	r := recordCommands(t)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.go")
+	writeFile(t, file)
+
+	opts := testOptions(dir)
+	opts.Include = []string{"*.go", filepath.Join(dir, "a.*")}
+	src := startRun(t, opts, file)
+	if !src.Send(file, "write") {
+		t.Fatalf("Event on %s not delivered", file)
+	}
+	waitRuns(t, r, 1)
+}
+
+func TestRunRenamedDir(t *testing.T) {
+	captureLog(t)
+	r := recordCommands(t)
+	dir := t.TempDir()
+	sub, moved := filepath.Join(dir, "sub"), filepath.Join(dir, "moved")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testOptions(dir)
+	opts.Recursive = true
+	opts.Command = []string{"true", "{{.Path}}"}
+	src := startRun(t, opts, filepath.Join(sub, "a.txt"))
+	if err := os.Rename(sub, moved); err != nil {
+		t.Fatal(err)
+	}
+	src.Send(sub, "rename")
+	src.Send(moved, "create")
+
+	file := filepath.Join(moved, "a.txt")
+	waitFor(t, "watching "+moved, func() bool { return src.Watched(file) })
+	writeFile(t, file)
+	if !src.Send(file, "write") {
+		t.Fatalf("Event on %s not delivered", file)
+	}
+	waitFor(t, "the command to run for "+file, func() bool { return r.ran(file) })
+}
+
+func TestRunPatternMatchedLater(t *testing.T) {
+	captureLog(t)
+	r := recordCommands(t)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.log")
+
+	src := startRun(t, testOptions(filepath.Join(dir, "*.log")), file)
+	// Not matching the pattern, it does not run the command
+	other := filepath.Join(dir, "a.txt")
+	writeFile(t, other)
+	src.Send(other, "create")
+	writeFile(t, file)
+	if !src.Send(file, "create") {
+		t.Fatalf("Event on %s not delivered", file)
+	}
+	waitRuns(t, r, 1)
+}
+
+func TestWatchParentMaxWatches(t *testing.T) {
+	logs := captureLog(t)
+	a, b := t.TempDir(), t.TempDir()
+	opts := testOptions(filepath.Join(a, "*.log"), filepath.Join(b, "*.log"))
+	opts.MaxWatches = 1
+	w := newTestWatcher(t, opts, NewMemorySource())
+	w.WatchPatterns(w.opts.Patterns)
+
+	if n := w.watchCount(); n != 1 {
+		t.Errorf("Watching %d paths, expected 1: %v", n, w.list)
+	}
+	if _, ok := w.seenAt(b); ok {
+		t.Errorf("Path %s watched beyond --max-watches", b)
+	}
+	if !strings.Contains(logs.String(), "--max-watches") {
+		t.Errorf("No warning about --max-watches logged:\n%s", logs)
+	}
+}
+
+func TestRunCreateMatching(t *testing.T) {
+	captureLog(t)
+	r := recordCommands(t)
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.txt"))
+
+	src := startRun(t, testOptions(filepath.Join(dir, "*.txt")), filepath.Join(dir, "a.txt"))
+	file := filepath.Join(dir, "b.txt")
+	writeFile(t, file)
+	if !src.Send(file, "create") {
+		t.Fatalf("Event on %s not delivered", file)
+	}
+	waitRuns(t, r, 1)
+}
@@ -19,40 +19,616 @@
 //
 // The above command will monitor recursivelly the src folder,
 // and execute the maven test compile target.
+//
+//     whenchange -p ./src/ -i '*.go' -i '*.sql' go test ./...
+//
+// The above command will monitor the src folder too, but only
+// changes to go and sql files will trigger go test.
+//
+//     whenchange -p ./src/ -i '*.go' -i '!*_test.go' go build
+//
+// The above command will run go build on changes to go files, except for
+// the tests. Include patterns starting with ! exclude the files they
+// match, and the last pattern matching a file decides.
+//
+//     whenchange -p 'src/**/*.go' go test ./...
+//
+// The above command will monitor the go files in the src folder and
+// all of its sub-folders, as ** matches any number of folders.
+//
+//     whenchange -p 'logs/*.log' ./report.sh
+//
+// The above command will run report.sh when log files are written, even
+// if none exist yet: the directory of a pattern that matches no file is
+// watched for the files created later that match it, and creating one
+// runs the command as well, unless create is left out of --events.
+//
+//     find . -name '*.go' | whenchange --patterns-from - go build
+//
+// The above command will monitor the files listed by find, reading them
+// from stdin, one per line.
+//
+//     whenchange --files 'a[1].go' b.go -- go build
+//
+// The above command will monitor exactly the files given, without
+// expanding wildcards in their names. Files that do not exist are
+// watched once created.
+//
+//     whenchange -p ./ --command-file build.sh
+//
+// The above command will run the build.sh script with the shell on
+// changes. It is read again for each run, so that changes to it are used
+// right away, but they do not run it, unless --watch-command-file is
+// given.
+//
+//     whenchange -p ./src/ --max-runtime 1h make test
+//
+// The above command will stop watching after an hour, as if interrupted,
+// and exit with the last failing exit code of make, if any.
+//
+//     whenchange -p ./src/ --fail-fast 3 --fail-fast-reset .reset make
+//
+// The above command will stop running make after it failed three times in
+// a row, until the .reset file is touched, or whenchange receives SIGUSR1.
+//
+//     whenchange -p ./incoming/ --watch-new-only ./process.sh '{{.Path}}'
+//
+// The above command will run process.sh for each file dropped in the
+// incoming folder, but not when the files already there are modified.
+// Files replaced by an atomic save are not new, and deleted files are
+// new again once created.
+//
+//
+// Configuration file
+//
+// Options can also be stored in a .whenchange.json file in the working
+// directory, or in the file given with --config:
+//
+//     {
+//         "patterns": ["./src/"],
+//         "exclude": ["node_modules"],
+//         "delay": "2s",
+//         "command": ["mvn", "test-compile"]
+//     }
+//
+// Flags given on the command line, and positional arguments for the
+// command, take precedence over the values in the file.
+//
+// The defaults of --shell and --delay can also be set with the
+// WHENCHANGE_SHELL and WHENCHANGE_DELAY environment variables, which the
+// configuration file and the flags take precedence over:
+//
+//     export WHENCHANGE_SHELL=zsh WHENCHANGE_DELAY=1s
+//
+// To check the options used once all of them are merged, --print-config
+// prints them as JSON, with the logging ones and the configuration file
+// read, and exits.
+//
+// Invalid options, such as a delay or a list of events that does not
+// parse, are logged, and replaced by their defaults. With --strict,
+// whenchange exits instead, before watching any path, so that a typo is
+// not missed, as in CI.
+//
+// On SIGHUP, the configuration file is read again, and the patterns,
+// files and exclusions from it are watched instead of the previous ones,
+// without a restart. The other options are kept until restarted:
+//
+//     kill -HUP $(pidof whenchange)
+//
+//
+// Debounce
+//
+// By default, the command runs on the first change, and the changes to
+// the same path within the delay are ignored. With --debounce=trailing,
+// the command runs instead once no change arrived for the delay, so it
+// always sees the final state of a series of saves:
+//
+//     whenchange -p ./src/ --debounce=trailing -d 1s make
+//
+// Delays can also be given as phrases, like --delay '1 minute 30 seconds'
+// or --delay '500 ms'. A delay of 0s disables debouncing, and the command
+// runs on every change. The first change to a path always runs the
+// command, however long the delay is, even right after startup.
+//
+// The delay sets both the minimum interval between runs for the same
+// path, and the time to wait for the changes to settle with
+// --debounce=trailing or --batch. They can be given separately with
+// --min-interval and --settle, for instance for an expensive build that
+// should run at most once a minute, but only after the editor finished
+// writing:
+//
+//     whenchange -p ./src/ --debounce=trailing --min-interval 1m --settle 500ms make
+//
+// Changes that settle before the minimum interval passed run once it
+// does.
+//
+// A pattern can be given its own delay, used for both, by adding
+// :delay= and a duration to it. The first pattern with a delay matching
+// a changed path is used, and the other paths use the flags:
+//
+//     whenchange -p ./src/ -p 'assets/*.png:delay=2s' -d 200ms make
+//
+// When several instances watch the same paths, as one per service in a
+// monorepo, a single save runs all of their commands at once. With
+// --jitter, each run waits a random delay up to the given duration
+// first, added to the settle time with --debounce=trailing or --batch.
+// Changes during that wait restart it, and run the command once:
+//
+//     whenchange -r -p ./ --jitter 5s make deploy
+//
+//
+// Ignore file
+//
+// Files and directories to skip can also be listed in a .whenchangeignore
+// file in the working directory, one pattern per line, as given with
+// --exclude. Blank lines and lines starting with # are skipped:
+//
+//     # Build output
+//     dist
+//     *.min.js
+//
+// The patterns in the file are used along with the ones given with
+// --exclude, or in the configuration file: a path matching any of them is
+// skipped.
+//
+// Hidden files and directories, whose names start with a dot, such as .git
+// or .idea, are skipped too when watching recursively, or when matched by
+// a wildcard, as '*' does not match them in the shell either. Patterns
+// naming them, as -p .env or -p '.config/*', still watch them. Use
+// --watch-hidden to watch all of them, as done before this was the
+// default.
+//
+//
+// Symbolic links
+//
+// Links to directories are not followed when watching recursively,
+// unless --follow-symlinks is given. Then their targets are watched too,
+// and each directory is walked only once, even if reached from several
+// links, so that a link to a parent directory, or watching a home
+// directory full of links, does not loop forever.
+//
+//
+// Atomic saves
+//
+// Many editors save a file by writing a temporary file and renaming it
+// over the target, or by renaming the target away and writing it again.
+// To run the command once for such a save, events on the temporary files
+// editors use, like vim swap files and backups ending in ~, are ignored,
+// and a file created less than a second after a rename in its directory
+// is taken as written. Use --coalesce-saves=false to turn this off.
+//
+// Tools that touch files without changing them, like a chmod run by a
+// deploy, also trigger the command. With --check-mtime, write and
+// attribute change events are ignored when the modification time, size
+// and mode of the file did not change. With --watch-mtime-only, all
+// events are ignored unless the modification time of the file advanced,
+// which also skips the permission changes reported as writes on some
+// platforms:
+//
+//     whenchange --watch-mtime-only -r -p ./src/ make
+//
+//
+// Large trees
+//
+// Watching a large tree recursively means walking all of it at startup.
+// With --state-file, the directories found are saved to a file, and the
+// next run only reads again the ones modified since then:
+//
+//     whenchange --state-file .whenchange.state -p ./ make
+//
+// The file is not used if the patterns or exclusions changed.
+//
+// To check which paths would be watched with the given patterns and
+// exclusions, use --list: it prints them, with their count, and exits.
+//
+// Changes to files outside a size range, such as large generated
+// artifacts, can be ignored with --min-size and --max-size, in bytes or
+// with a K, M or G suffix:
+//
+//     whenchange -p ./ --max-size 1MB make
+//
+// Each file matched by the patterns is watched, along with its directory.
+// In directories with thousands of files, --dir-watch-only watches the
+// directories only, which report the changes to their files on Linux and
+// Windows, but not the writes on macOS and BSD:
+//
+//     whenchange -p 'data/*.csv' --dir-watch-only ./import.sh
+//
+//
+// Polling
+//
+// File system events are not delivered reliably on network mounts, such
+// as NFS or SMB, and in some container volumes. In that case, use --poll
+// with an interval to check the watched paths for changes instead:
+//
+//     whenchange --poll 1s -p ./src/ make
+//
+//
+// Rules
+//
+// To run different commands for different files, give each pattern and
+// command as a --rule, instead of a command:
+//
+//     whenchange --rule '*.go=>go build' --rule '*.proto=>go generate ./...'
+//
+// Several patterns can be given separated by commas. A rule matches a
+// changed path if one of its patterns matches the path or its base name,
+// or the directory it is in. The commands of all matching rules run, in
+// the order the rules are given, on the command line or in the
+// configuration file. With --first-match, only the first of them runs,
+// so that a more specific rule can be given before a general one:
+//
+//     whenchange --first-match --rule 'docs/*=>make docs' --rule '*=>make'
+//
+// Changes are debounced per path. With --debounce-per-command, they are
+// debounced per rule instead, so that the command of a rule does not run
+// again within the delay, whatever the path, but the other rules do. With
+// --parallel, the changes that arrive while the command of a rule runs
+// also wait for it to finish, and the last one runs then.
+//
+// In the configuration file, use a list of objects with patterns and
+// command:
+//
+//     {
+//         "rules": [
+//             {"patterns": ["*.go"], "command": ["go", "build"]},
+//             {"patterns": ["*.proto"], "command": ["go", "generate", "./..."]}
+//         ]
+//     }
+//
+//
+// Placeholders
+//
+// The command can refer to the file that triggered it, using
+// text/template placeholders:
+//
+//     whenchange -p 'src/*.js' eslint '{{.Path}}'
+//
+// Available placeholders are {{.Path}} (the changed file), {{.Dir}}
+// (its directory), {{.Name}} (its base name) and {{.Ext}} (its
+// extension, including the dot). Values are not quoted for the shell,
+// and paths are relative to the current directory, even if the command
+// runs from another one with --working-dir, unless --absolute-paths is
+// given. The environment variables have the same paths.
+//
+// {{.MatchedPattern}} is the pattern, or the path given with --files,
+// that matched the changed file or the directory it is in, so that a
+// single command can tell where the change came from, and {{.Rule}} is
+// the index of the rule running with --rule, starting at 0:
+//
+//     whenchange -r -p ./api/ -p ./web/ 'make -C {{.MatchedPattern}}'
+//
+// Since changes are debounced per file, if several files change within
+// the delay the command runs once for each distinct path, unless --batch
+// is given.
+//
+//
+// Shells
+//
+// The command runs with bash -c by default. Use --shell and --shell-args
+// to run it with another shell, for instance:
+//
+//     whenchange --shell sh --shell-args -c ...
+//     whenchange --shell bash --shell-args -lc ...
+//     whenchange --shell fish --shell-args -c ...
+//     whenchange --shell cmd.exe --shell-args /C ...
+//     whenchange --shell pwsh --shell-args '-NoProfile -Command' ...
+//
+// The --pre and --post hooks run with the same shell. If it is not
+// installed, as bash in minimal containers, whenchange exits at startup:
+// use --shell sh, or --no-shell to run the command without a shell.
+//
+// Many tools only write colors and progress bars when their output is a
+// terminal. With --pty, on Linux, the command runs in a pseudo-terminal,
+// and its output is copied to the one of whenchange. If it can't be
+// allocated, a warning is logged and the command runs without one:
+//
+//     whenchange --pty -p ./src/ npm test
+//
+//
+// Batch mode
+//
+// With --batch, changes are collected until no change arrived for the
+// delay, and then the command runs a single time. The list of changed
+// files is available to the command in the WHENCHANGE_FILES environment
+// variable, one per line, and placeholders refer to the most recent one.
+//
+// With --files-to-stdin, the list is also written to the command stdin,
+// for tools that read the files to work on from it, without limits on
+// the length of the command line:
+//
+//     whenchange --batch --files-to-stdin -p ./src/ xargs gofmt -l
+//
+// With --group-by-dir, which implies --batch, the command runs once for
+// each directory with changes instead, one after the other, in the order
+// they changed. The placeholders refer to the most recent change in the
+// directory, so {{.Dir}} is the directory, and WHENCHANGE_FILES has the
+// files changed in it, as for the Go packages edited:
+//
+//     whenchange -r --group-by-dir -p ./ 'go test ./{{.Dir}}'
+//
+// With --files-tmpfile, the list is written to a temporary file instead,
+// removed once the command and its hooks finished. Its path is in the
+// WHENCHANGE_FILELIST environment variable and the {{.FileList}}
+// placeholder, for tools that read arguments from @file:
+//
+//     whenchange --batch --files-tmpfile -p ./src/ javac '@{{.FileList}}'
+//
+// Without --batch, bulk operations, such as a git checkout or removing and
+// creating a tree again, are handled the same way: once 50 paths changed
+// one right after the other, the next changes are collected until none
+// arrived for a second, or the delay if longer, and the command runs once
+// for all of them. With a delay, the command waits 200ms after a change
+// before running, so that the changes at the start of the operation are
+// collected as well.
+//
+//
+// Parallel runs
+//
+// Commands run one after the other by default. With --parallel N, up to N
+// of them run at the same time, and the others wait for one to finish,
+// which is useful with placeholders to run a command for each file saved.
+// The output of the commands is written a line at a time, so lines from
+// different commands are not mixed up.
+//
+//
+// HTTP endpoints
+//
+// With --http-addr, whenchange serves two endpoints on that address:
+// GET /status reports as JSON the time the last run started, its exit
+// code and the number of watched paths, and POST /trigger runs the
+// command, as if a change happened:
+//
+//     whenchange --http-addr localhost:8080 -p ./src/ make
+//     curl -X POST localhost:8080/trigger
+//
+// With --metrics-addr, GET /metrics reports, in the Prometheus text
+// format, the number of watched paths, of events received, of runs and
+// of failed ones, and the duration of the last run, to monitor many
+// instances:
+//
+//     whenchange --metrics-addr :9090 -p ./src/ make
+//
+//
+// Logging
+//
+// Messages are written to stderr as text lines. With --log-format=json,
+// each one is written instead as a JSON object on its own line, with the
+// time, level, event and message, and details such as the path, command,
+// exit_code and duration, in seconds, when available. The output of the
+// command is not changed.
+//
+// With --log-file, the messages are appended to a file instead, which
+// tools like logrotate can rotate with copytruncate, while the output of
+// the command is still written to the terminal:
+//
+//     whenchange --log-file whenchange.log -p ./src/ make
+//
+// Text messages are colored when written to a terminal: errors in red,
+// warnings in yellow, the exit of the command in green or red by its
+// result, and the others dimmed. Use --color=always or --color=never to
+// choose, or set NO_COLOR.
+//
+// More messages are written with -v, which can be given up to three
+// times, as -vv or -vvv, or as --verbosity=N: level 1 logs the settings
+// and the changes that run the command, level 2 also the events ignored
+// and why, and level 3 also each path added to the watch list or
+// skipped. In JSON, the level of these messages is in verbosity.
+//
+// With --summary-on-exit, the number of runs, of failed ones, and the
+// time spent running the command are logged when whenchange exits.
+//
+// To check that whenchange is still alive during quiet periods, as over
+// SSH, --heartbeat logs the number of watched paths, and the time since
+// the last change, at the given interval:
+//
+//     whenchange --heartbeat 10m -p ./src/ make
+//
+//
+// Environment
+//
+// The command receives the details of the change in environment
+// variables: WHENCHANGE_PATH has the changed file, WHENCHANGE_EVENT the
+// event type (write, create, delete, rename or attrib, startup when run
+// because of --run-on-start, startup-since when run at startup for a
+// file modified after --since, or trigger when run by POST /trigger),
+// and, in batch mode, WHENCHANGE_FILES has all the changed files, one
+// per line.
+//
+// More variables can be given in a file with --env-file, as KEY=VALUE
+// lines, such as the ones in a .env file. The file is read again before
+// each run, so changes to it are used right away.
+//
+// The command stdin is connected to /dev/null, so that commands that read
+// from it do not wait for input. Use --stdin-file to give it the contents
+// of a file instead, read again before each run, or --stdin-null=false to
+// give it the terminal whenchange runs in. With --files-to-stdin, the
+// changed files are written to it in batch mode:
+//
+//     whenchange -p ./src/ --stdin-file request.json 'curl -d @- localhost:8080'
+//
+// Commands to run with the shell before and after each run can be given
+// with --pre and --post. The command is skipped if the --pre one fails,
+// and the --post one has its exit code in WHENCHANGE_EXIT_CODE:
+//
+//     whenchange -p ./src/ --post 'test $WHENCHANGE_EXIT_CODE = 0 || notify-send failed' make
+//
+// To run a command only when the command fails, use --on-error instead. It
+// has the failed command in WHENCHANGE_COMMAND as well:
+//
+//     whenchange -p ./src/ --on-error 'paplay /usr/share/sounds/error.oga' make
 
 package main // import "ronoaldo.gopkg.net/whenchange"
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"os/exec"
-	"path"
-	"path/filepath"
+	"os/signal"
+	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
-
-	"gopkg.in/fsnotify.v0"
 )
 
 var (
 	// List of paths to watch
 	patternList Patterns
+	// File to read more paths to watch from, one per line, or - for stdin
+	patternsFrom string
+	// List of paths to watch as they are, without expanding wildcards
+	fileList Patterns
+	// List of paths to skip when watching
+	excludeList Patterns
+	// List of files that trigger the command, all if empty
+	includeList Patterns
+	// Skip paths ignored by .gitignore files
+	useGitignore bool
 	// Watch directory recursively
 	recursive bool
+	// Do not watch directories recursively
+	shallow bool
+	// Follow symlinks to directories when watching recursively
+	followSymlinks bool
+	// Watch hidden files and directories too
+	watchHidden bool
 	// Command to execute on changes
 	cmd []string
-	// verbose options
-	verbose bool
-	// fsnotify.Watcher to monitor changes
-	watcher *Watcher
-	// Shell to use when running the command
-	shell string
-	// Delay between repeated executions of command
-	delaySpec string
-	delay     time.Duration
+	// Patterns and commands to run for them, instead of cmd
+	ruleList Rules
+	// Run only the first rule matching a change
+	firstMatch bool
+	// verbose options, as a level
+	verbose Verbosity
+	// Log every event received, and how it was handled
+	trace bool
+	// Log a summary of the runs when exiting
+	summaryOnExit bool
+	// Interval to log that whenchange is still watching at, 0 means never
+	heartbeat time.Duration
+	// Shell to use when running the command, and the arguments given to
+	// it before the command string
+	shell     string
+	shellArgs string
+	// Delay between repeated executions of command, used for both the
+	// minimum interval and the settle time unless given
+	delaySpec       string
+	minIntervalSpec string
+	settleSpec      string
+	// Maximum random delay before running the command
+	jitter time.Duration
+	// Debounce mode, leading or trailing, and whether per command
+	debounce           string
+	debouncePerCommand bool
+	// Handle the events of an editor atomic save as a single write
+	coalesceSaves bool
+	// Skip events for files whose modification time, size and mode did
+	// not change
+	checkMtime bool
+	// Skip all events unless the modification time of the file advanced
+	watchMtimeOnly bool
+	// Sizes of the files to run the command for, empty means no limit
+	minSizeSpec string
+	maxSizeSpec string
+	// Interval to poll the watched paths at, 0 means no polling
+	poll time.Duration
+	// Maximum number of watched paths, 0 means no limit
+	maxWatches int
+	// Watch files through their directory only
+	dirWatchOnly bool
+	// Kill the running command when a new change arrives
+	restart bool
+	// Ignore the changes made while the command runs
+	ignoreDuringRun bool
+	// Maximum time a command is allowed to run, 0 means no limit
+	timeout time.Duration
+	// Maximum time to watch for changes before exiting, 0 means no limit
+	maxRuntime time.Duration
+	// Time the command has to exit after SIGTERM, before SIGKILL
+	grace time.Duration
+	// Maximum number of commands to run at the same time
+	parallel int
+	// Times to retry a failed command, and the delay between attempts
+	retries    int
+	retryDelay time.Duration
+	// Failed runs in a row after which the runs are paused, and the file
+	// whose changes resume them
+	failFast  int
+	resetFile string
+	// Exit after the first change, with the command exit code
+	once bool
+	// Send a desktop notification after each run
+	notifyDone bool
+	// Log the command instead of running it
+	dryRun bool
+	// Print the paths that would be watched, and exit
+	list bool
+	// Print the options, once merged, and exit
+	printConfig bool
+	// Run the command directly, without a shell
+	noShell bool
+	// Script to run with the shell instead of the command arguments
+	commandFile string
+	// Run the command when the command file changes
+	watchCommandFile bool
+	// Directory to run the command from
+	workingDir string
+	// Give absolute paths to the command
+	absolutePaths bool
+	// Run the command in a pseudo-terminal
+	pty bool
+	// File with environment variables for the command
+	envFile string
+	// File to give to the command as its stdin
+	stdinFile string
+	// Connect the command stdin to /dev/null
+	stdinNull bool
+	// Commands to run before and after the command
+	pre  string
+	post string
+	// Command to run when the command fails
+	onError string
+	// Label added to each line of the command output
+	prefix string
+	// Run the command once for all changes, after a quiet delay
+	batch bool
+	// Run the command once for each directory with changes
+	groupByDir bool
+	// Write the changed files to the command stdin in batch mode
+	filesToStdin bool
+	// Write the changed files to a temporary file in batch mode
+	filesTmpfile bool
+	// Run the command once at startup
+	runOnStart bool
+	// Address to serve the status and trigger endpoints on
+	httpAddr string
+	// Address to serve the metrics on
+	metricsAddr string
+	// Run the command at startup for files modified since then
+	since string
+	// Configuration file to load options from
+	configFile string
+	// File to cache the watched directory tree in
+	stateFile string
+	// Event types that trigger the command
+	eventSpec string
+	// Only run the command for new paths
+	watchNewOnly bool
+	// Format of the log messages, text or json
+	logFormat string
+	// File to write the log messages to, or - for stderr
+	logFile string
+	// Whether to color the log messages: auto, always or never
+	color string
+	// Only log warnings and errors
+	quiet bool
+	// Exit on invalid options, instead of using their defaults
+	strict bool
 )
 
 // Type Patterns represents a set of paths to watch for.
@@ -69,187 +645,563 @@ func (p *Patterns) Set(value string) error {
 	return nil
 }
 
-type Watcher struct {
-	*fsnotify.Watcher
-	list   map[string]time.Time
-	listMu sync.Mutex
+// ReadPatterns reads the patterns in r, one per line. Spaces around them,
+// blank lines and lines starting with # are skipped.
+func ReadPatterns(r io.Reader) ([]string, error) {
+	var patterns []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, s.Err()
 }
 
-// Watch starts monitoring a file path. It also monitors the
-// directory for changes, so attribute changes are also visible.
-func (w *Watcher) Watch(file string) {
-	w.listMu.Lock()
-	defer w.listMu.Unlock()
+// readPatternsFrom reads the patterns in the file name, or in stdin if
+// name is -.
+func readPatternsFrom(name string) ([]string, error) {
+	if name == "-" {
+		return ReadPatterns(os.Stdin)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadPatterns(f)
+}
 
-	towatch := []string{file}
-	// Also monitors the directory, if file, so attrib changes
-	// and timestamp changes are visible as well.
-	if !IsDir(file) {
-		towatch = append(towatch, path.Dir(file))
+// loadIgnoreFile adds the patterns in the .whenchangeignore file in the
+// working directory, if present, to the exclusions. Errors are logged,
+// and the file is skipped.
+func loadIgnoreFile() {
+	patterns, err := readPatternsFrom(defaultIgnoreFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		configErrorf("Skipping it", "Unable to read %s: %v", defaultIgnoreFile, err)
+		return
+	}
+	if verbose > 0 {
+		logger.Log("debug", "config", Fields{"path": defaultIgnoreFile}, "Loaded %d exclusions from %s", len(patterns), defaultIgnoreFile)
 	}
+	excludeList = append(excludeList, patterns...)
+}
 
-	for _, file := range towatch {
-		if _, ok := w.list[file]; ok {
-			verbosef("Path %s already in watch list", file)
-			return
-		}
-		verbosef("Watching [%s]", file)
-		err := w.Watcher.Watch(file)
-		if err != nil {
-			log.Fatal(err)
+// Type Verbosity is the level of verbose output. As a flag, each -v raises
+// it by one, and -v=N sets it to N.
+type Verbosity int
+
+// Method String implements the flags.Value interface.
+func (v *Verbosity) String() string {
+	return strconv.Itoa(int(*v))
+}
+
+// Method Set implements the flags.Value interface.
+func (v *Verbosity) Set(value string) error {
+	switch value {
+	case "true":
+		*v++
+	case "false":
+		*v = 0
+	default:
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid verbosity %q", value)
 		}
-		// To prevent ignoring the very first change, use a time machine and
-		// go back in time :D
-		w.list[file] = time.Now().Add(-5 * time.Second)
-	}
-}
-
-// WatchPatterns lookup all gob matches from patterns and watch them.
-// If -r/--recursive is true, walks all sub-trees recursivelly.
-func (w *Watcher) WatchPatterns(patterns []string) {
-	for _, p := range patterns {
-		if glob, err := filepath.Glob(p); err == nil {
-			for _, fname := range glob {
-				watcher.Watch(fname)
-				if recursive {
-					for _, s := range SubDirs(fname) {
-						watcher.Watch(s)
-					}
-				}
-			}
+		*v = Verbosity(n)
+	}
+	return nil
+}
+
+// Method IsBoolFlag allows -v to be given without a value.
+func (v *Verbosity) IsBoolFlag() bool {
+	return true
+}
+
+// Type verbosityLevel is the flag.Value of -vv and -vvv, which set the
+// Verbosity to level, and of --verbosity, which takes the level as value
+// when level is 0.
+type verbosityLevel struct {
+	v     *Verbosity
+	level int
+}
+
+// Method String implements the flags.Value interface.
+func (l verbosityLevel) String() string {
+	if l.v == nil {
+		return "0"
+	}
+	return l.v.String()
+}
+
+// Method Set implements the flags.Value interface.
+func (l verbosityLevel) Set(value string) error {
+	if l.level == 0 {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid verbosity %q", value)
 		}
+		*l.v = Verbosity(n)
+		return nil
 	}
+	on, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	if on {
+		*l.v = Verbosity(l.level)
+	} else {
+		*l.v = 0
+	}
+	return nil
+}
+
+// Method IsBoolFlag allows -vv and -vvv to be given without a value.
+func (l verbosityLevel) IsBoolFlag() bool {
+	return l.level > 0
 }
 
 func init() {
-	flag.StringVar(&delaySpec, "delay", "5s", "Delay between repeated executions of command")
-	flag.StringVar(&delaySpec, "d", "5s", "Delay between repeated executions of command (shorthand)")
-	flag.BoolVar(&recursive, "recursive", true, "Watch directories recursively")
+	defineFlags()
+}
+
+// defineFlags defines the command line flags on flag.CommandLine, with
+// their defaults set in the variables above, and the usage message.
+func defineFlags() {
+	flag.StringVar(&delaySpec, "delay", envDefault("WHENCHANGE_DELAY", "5s"), "Delay between repeated executions of command, like 5s or '2 seconds'")
+	flag.StringVar(&delaySpec, "d", envDefault("WHENCHANGE_DELAY", "5s"), "Delay between repeated executions of command (shorthand)")
+	flag.StringVar(&minIntervalSpec, "min-interval", "", "Minimum time between executions of command for the same path (default: --delay)")
+	flag.DurationVar(&jitter, "jitter", 0, "Wait a random delay, up to this duration, before running the command for a change (0 means no delay)")
+	flag.StringVar(&settleSpec, "settle", "", "Time without changes to wait for before running, with --debounce=trailing or --batch (default: --delay)")
+	flag.BoolVar(&debouncePerCommand, "debounce-per-command", false, "Debounce the changes per command of each rule, instead of per path, and wait for the command to finish with --parallel")
+	flag.StringVar(&debounce, "debounce", debounceLeading, "Run on the first change and ignore the next ones for the delay (leading), or wait until no change arrived for the delay (trailing)")
+	flag.BoolVar(&coalesceSaves, "coalesce-saves", true, "Ignore editor temporary files, and take a rename followed by a create as a single write")
+	flag.StringVar(&minSizeSpec, "min-size", "", "Ignore events for files smaller than this size, like 10K")
+	flag.StringVar(&maxSizeSpec, "max-size", "", "Ignore events for files larger than this size, like 1MB")
+	flag.BoolVar(&checkMtime, "check-mtime", false, "Ignore write and attribute events for files whose modification time, size and mode did not change")
+	flag.BoolVar(&watchMtimeOnly, "watch-mtime-only", false, "Ignore all events unless the modification time of the file advanced, like for permission changes (overrides --check-mtime)")
+	flag.DurationVar(&poll, "poll", 0, "Poll the watched paths at this interval, instead of using file system events (0 means no polling)")
+	flag.IntVar(&maxWatches, "max-watches", 0, "Maximum number of paths to watch, the next ones are skipped (0 means no limit)")
+	flag.BoolVar(&dirWatchOnly, "dir-watch-only", false, "Watch files through their directory only, to use fewer watches in directories with many files")
+	flag.BoolVar(&recursive, "recursive", true, "Watch directories recursively (use --shallow to turn it off)")
 	flag.BoolVar(&recursive, "r", true, "Watch directories recursively (shorthand)")
-	flag.BoolVar(&verbose, "verbose", false, "Output verbose information")
-	flag.BoolVar(&verbose, "v", false, "Output verbose information (shorthand)")
-	flag.Var(&patternList, "pattners", "Files and directories to watch, as a gob pattern")
+	flag.BoolVar(&shallow, "shallow", false, "Watch only the given directories, and not their sub-directories")
+	flag.BoolVar(&followSymlinks, "follow-symlinks", false, "Watch the targets of symlinks to directories when watching recursively")
+	flag.BoolVar(&watchHidden, "watch-hidden", false, "Watch the hidden files and directories, starting with a dot, matched by wildcards or found when watching recursively")
+	flag.Var(&verbose, "verbose", "Output verbose information, more each time it is given")
+	flag.Var(&verbose, "v", "Output verbose information, more each time it is given (shorthand)")
+	flag.Var(verbosityLevel{&verbose, 2}, "vv", "Output verbose information, with the events ignored")
+	flag.Var(verbosityLevel{&verbose, 3}, "vvv", "Output verbose information, with the events ignored and the changes to the watch list")
+	flag.Var(verbosityLevel{&verbose, 0}, "verbosity", "Level of verbose output, from 0 to 3")
+	flag.BoolVar(&trace, "trace", false, "Log every file system event received, and how it was handled")
+	flag.BoolVar(&summaryOnExit, "summary-on-exit", false, "Log the number of runs, failures and time spent running the command when exiting")
+	flag.DurationVar(&heartbeat, "heartbeat", 0, "Log that whenchange is still watching, and for how long no change arrived, at this interval (0 means never)")
+	flag.Var(&patternList, "patterns", "Files and directories to watch, as a gob pattern")
+	deprecate("pattners", "patterns")
 	flag.Var(&patternList, "p", "Files and directories to watch, as a gob pattern (shorthand)")
-	flag.StringVar(&shell, "shell", "bash", "The shell to use when running the command")
+	flag.Var(&fileList, "files", "Files and directories to watch, as they are, without expanding wildcards. The arguments up to a -- are more files")
+	flag.StringVar(&patternsFrom, "patterns-from", "", "File to read more patterns from, one per line, or - to read them from stdin")
+	flag.Var(&excludeList, "exclude", "Files and directories to skip, as a gob pattern")
+	flag.Var(&excludeList, "x", "Files and directories to skip, as a gob pattern (shorthand)")
+	flag.Var(&includeList, "include", "Files that trigger the command, as a gob pattern, or not if it starts with ! (default all watched files)")
+	flag.Var(&includeList, "i", "Files that trigger the command, as a gob pattern (shorthand)")
+	flag.BoolVar(&useGitignore, "gitignore", false, "Skip files and directories ignored by .gitignore")
+	flag.BoolVar(&restart, "restart", false, "Kill the running command when a new change arrives, then run it again")
+	flag.BoolVar(&restart, "kill", false, "Kill the running command when a new change arrives, then run it again (alias)")
+	flag.BoolVar(&ignoreDuringRun, "ignore-during-run", false, "Ignore the changes made while the command runs, and until the settle time passed after it exits, such as its own output files")
+	flag.DurationVar(&timeout, "timeout", 0, "Kill the command if it runs longer than this (0 means no limit)")
+	flag.DurationVar(&maxRuntime, "max-runtime", 0, "Exit after watching for this long, with the last failing exit code of the command (0 means no limit)")
+	flag.DurationVar(&grace, "grace", killGrace, "Time the command has to exit after SIGTERM, when stopped, before it is killed with SIGKILL")
+	flag.IntVar(&parallel, "parallel", 1, "Maximum number of commands to run at the same time, instead of one after the other")
+	flag.IntVar(&retries, "retries", 0, "Times to run the command again when it fails, until a new change arrives. Not used with --restart or --parallel")
+	flag.DurationVar(&retryDelay, "retry-delay", time.Second, "Delay before each retry of a failed command")
+	flag.IntVar(&failFast, "fail-fast", 0, "Stop running the command after it failed this many times in a row, until --fail-fast-reset changes or SIGUSR1 is received (0 means never)")
+	flag.StringVar(&resetFile, "fail-fast-reset", "", "File whose changes resume the runs paused by --fail-fast")
+	flag.BoolVar(&once, "once", false, "Exit after running the command once, with its exit code")
+	flag.BoolVar(&notifyDone, "notify", false, "Send a desktop notification with the result after each run of the command")
+	flag.BoolVar(&dryRun, "dry-run", false, "Log the command that would run on each change, without running it")
+	flag.BoolVar(&list, "list", false, "Print the paths that would be watched, and exit without running the command")
+	flag.BoolVar(&printConfig, "print-config", false, "Print as JSON the options given with the flags, the configuration file and the environment, once merged, and exit")
+	flag.StringVar(&shell, "shell", envDefault("WHENCHANGE_SHELL", "bash"), "The shell to use when running the command")
+	flag.StringVar(&shellArgs, "shell-args", "-c", "Space separated arguments given to the shell before the command, like /C for cmd.exe")
+	flag.BoolVar(&batch, "batch", false, "Run the command once for all changes, after no change arrived for the delay")
+	flag.BoolVar(&groupByDir, "group-by-dir", false, "Run the command once for each directory with changes, after no change arrived for the delay (implies --batch)")
+	flag.BoolVar(&filesToStdin, "files-to-stdin", false, "Write the changed files to the command stdin with --batch, one per line")
+	flag.BoolVar(&filesTmpfile, "files-tmpfile", false, "Write the changed files to a temporary file with --batch, one per line, and give its path in WHENCHANGE_FILELIST and {{.FileList}}")
+	flag.StringVar(&eventSpec, "events", defaultEvents, "Comma-separated event types that trigger the command: write, create, delete, rename, attrib")
+	flag.BoolVar(&watchNewOnly, "watch-new-only", false, "Only run the command for paths created while watching, ignoring changes to the existing ones")
+	flag.Var(&ruleList, "rule", "Rule to run a command when files matching its patterns change, as 'pattern,...=>command' (can be repeated)")
+	flag.BoolVar(&firstMatch, "first-match", false, "Run only the first rule matching a change, instead of all of them")
+	flag.StringVar(&workingDir, "working-dir", "", "Directory to run the command from, instead of the current one")
+	flag.BoolVar(&absolutePaths, "absolute-paths", false, "Give the changed paths to the command, in the environment and the placeholders, as absolute paths")
+	flag.BoolVar(&pty, "pty", false, "Run the command in a pseudo-terminal, so that it writes colors and progress bars as when run interactively (Linux only)")
+	flag.StringVar(&workingDir, "C", "", "Directory to run the command from, instead of the current one (shorthand)")
+	flag.StringVar(&pre, "pre", "", "Command to run with the shell before each run of the command, which is skipped if it fails")
+	flag.StringVar(&post, "post", "", "Command to run with the shell after each run of the command, with its exit code in WHENCHANGE_EXIT_CODE")
+	flag.StringVar(&onError, "on-error", "", "Command to run with the shell after each failed run of the command, with its exit code in WHENCHANGE_EXIT_CODE")
+	flag.StringVar(&envFile, "env-file", "", "File with KEY=VALUE lines to add to the environment of the command, read again before each run")
+	flag.StringVar(&stdinFile, "stdin-file", "", "File to give to the command as its stdin, read again before each run")
+	flag.BoolVar(&stdinNull, "stdin-null", true, "Connect the command stdin to /dev/null, use --stdin-null=false to give it the stdin of whenchange")
+	flag.StringVar(&prefix, "prefix", "", "Label to add to the start of each line of the command output, such as '[build] '")
+	flag.BoolVar(&noShell, "no-shell", false, "Run the command directly, without a shell")
+	flag.StringVar(&commandFile, "command-file", "", "Script to run with the shell on changes, instead of a command, read again on each run")
+	flag.BoolVar(&watchCommandFile, "watch-command-file", false, "Run the command when the --command-file changes too, if watched")
+	flag.BoolVar(&runOnStart, "run-on-start", false, "Run the command once at startup, before any change")
+	flag.StringVar(&since, "since", "", "Run the command at startup for the files modified since then, given as a duration such as 10m, or a time such as 2006-01-02T15:04:05Z")
+	flag.BoolVar(&quiet, "quiet", false, "Only log warnings and errors, and not each run of the command (--verbose takes precedence)")
+	flag.BoolVar(&quiet, "q", false, "Only log warnings and errors, and not each run of the command (shorthand)")
+	flag.BoolVar(&strict, "strict", false, "Exit on invalid options, such as a delay or events list that does not parse, instead of using their defaults")
+	flag.StringVar(&logFormat, "log-format", "text", "Format of the log messages: text, or json for one object per line")
+	flag.StringVar(&logFile, "log-file", "-", "File to append the log messages to, or - for stderr. The output of the command is not written to it")
+	flag.StringVar(&color, "color", "auto", "Color the log messages: auto, when writing to a terminal, always or never")
+	flag.StringVar(&stateFile, "state-file", "", "File to cache the watched directories in, so that large trees are walked faster on the next run")
+	flag.StringVar(&httpAddr, "http-addr", "", "Address to serve GET /status and POST /trigger on, such as localhost:8080")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Address to serve GET /metrics on, in the Prometheus text format, such as localhost:9090")
+	flag.StringVar(&configFile, "config", "", "Configuration file to load options from (default "+defaultConfigFile+", if present)")
 	flag.Usage = func() {
 		w := os.Stderr
 		fmt.Fprintf(w, "Usage: whenchange [options] commands\n")
 		fmt.Fprintf(w, "All positional arguments will compose the resulting command to execute\n")
+		fmt.Fprintf(w, "Directories are watched recursively, unless --shallow is given\n")
 		fmt.Fprintf(w, "Options can be:\n")
-		flag.PrintDefaults()
+		printDefaults(w)
 	}
 }
 
-func main() {
-	// Parse and print help
-	flag.Parse()
-	cmd = flag.Args()
-	verbosef("Command to execute: %v", cmd)
+// Old flag names, still accepted but hidden from the usage, and the
+// names that replace them.
+var deprecatedFlags = make(map[string]string)
 
-	var err error
-	fsw, err := fsnotify.NewWatcher()
-	if err != nil {
-		log.Fatal(err)
-	}
-	watcher = &Watcher{Watcher: fsw, list: make(map[string]time.Time)}
-	defer watcher.Close()
+// Type deprecatedValue is the value of a flag registered under an old
+// name. It warns when used, and sets the value of the new flag.
+type deprecatedValue struct {
+	flag.Value
+	name, replacement string
+}
 
-	if len(patternList) < 1 {
-		patternList.Set("./")
-	}
+// Deprecated flags given, to warn about once the logger is set up.
+var usedDeprecated []*deprecatedValue
 
-	delay, err = time.ParseDuration(delaySpec)
-	if err != nil {
-		log.Printf("Invalid duration: %s. Using 5s instead", delaySpec)
-		delay = 5 * time.Second
+// Method Set implements the flags.Value interface.
+func (d *deprecatedValue) Set(value string) error {
+	usedDeprecated = append(usedDeprecated, d)
+	return d.Value.Set(value)
+}
+
+// warnDeprecated logs a warning for each deprecated flag given.
+func warnDeprecated() {
+	for _, d := range usedDeprecated {
+		warnf("flag", Fields{"flag": d.name, "replacement": d.replacement}, "Flag -%s is deprecated, use -%s instead", d.name, d.replacement)
 	}
+}
 
-	verbosef("Path list %v", patternList)
-	watcher.WatchPatterns(patternList)
+// deprecate registers name as a deprecated alias of the flag replacement.
+func deprecate(name, replacement string) {
+	f := flag.Lookup(replacement)
+	flag.Var(&deprecatedValue{Value: f.Value, name: name, replacement: replacement}, name, f.Usage)
+	deprecatedFlags[name] = replacement
+}
 
-	for {
-		select {
-		case ev := <-watcher.Event:
-			HandleEvent(ev)
-		case err := <-watcher.Error:
-			HandleError(err)
+// printDefaults prints the usage of all flags to w, like
+// flag.PrintDefaults does, except for the deprecated ones.
+func printDefaults(w io.Writer) {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(w)
+	flag.VisitAll(func(f *flag.Flag) {
+		if _, ok := deprecatedFlags[f.Name]; ok {
+			return
 		}
+		fs.Var(f.Value, f.Name, f.Usage)
+		fs.Lookup(f.Name).DefValue = f.DefValue
+	})
+	fs.PrintDefaults()
+}
+
+// checkShell exits with an error if the shell is needed, to run the
+// command or the hooks, but is not installed, as in minimal containers
+// without bash, rather than failing on the first change.
+func checkShell() error {
+	if printConfig || list || dryRun || noShell && pre == "" && post == "" && onError == "" {
+		return nil
 	}
+	if _, err := exec.LookPath(shell); err != nil {
+		return fmt.Errorf("unable to find the shell: %v. Use --shell sh, or --no-shell to run the command directly", err)
+	}
+	return nil
 }
 
-// Func HandleEvent monitors for changes, executes the specified command
-// and keep monitoring for new folders when added.
-func HandleEvent(ev *fsnotify.FileEvent) {
-	path := filepath.Clean(ev.Name)
-	if ev.IsCreate() {
-		// New file added, check if it matches the patterns
-		watcher.WatchPatterns(patternList)
+func main() {
+	opts, err := parseFlags()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if printConfig {
+		if err := PrintConfig(os.Stdout, opts); err != nil {
+			fatalf("Unable to print the options: %v", err)
+		}
 		return
 	}
-	// Locking, because we will change the path map
-	watcher.listMu.Lock()
-	defer watcher.listMu.Unlock()
 
-	now := time.Now()
-	wtime, watching := watcher.list[path]
-	if !watching {
-		return
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if maxRuntime > 0 {
+		// Shut down as if interrupted, with the last exit code
+		t := time.AfterFunc(maxRuntime, func() {
+			infof("shutdown", Fields{"duration": maxRuntime.Seconds()}, "Max runtime reached, exiting")
+			stop()
+		})
+		defer t.Stop()
 	}
-	if now.Sub(wtime) < delay {
-		verbosef("File %s changed too fast. Ignoring this change.", path)
-		return
+	// Errors in the options read again on SIGHUP are not fatal
+	strict = false
+	opts.Reload = ReloadConfig
+	err = Run(ctx, opts)
+	if status, ok := err.(ExitStatus); ok {
+		os.Exit(int(status))
+	} else if err != nil {
+		fatalf("%v", err)
 	}
+}
 
-	verbosef("%s changed (%s)", path, ev)
-	watcher.list[path] = now
-	// Run command
-	if len(cmd) > 0 {
-		c := strings.Join(cmd, " ")
-		log.Printf("Running command '%s' ...", c)
-		cmd := exec.Command(shell, "-c", c)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err := cmd.Run()
+// parseFlags parses the command line flags, applies the configuration
+// file, and returns the Options to run with, before anything is watched.
+// It returns an error for the options that can't be used together, or
+// for the first invalid option with --strict.
+func parseFlags() (Options, error) {
+	// Parse and print help
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		return Options{}, err
+	}
+	cmd = flag.Args()
+	if len(fileList) > 0 {
+		// As in whenchange --files a.go b.go -- go build
+		for i, arg := range cmd {
+			if arg == "--" {
+				fileList = append(fileList, cmd[:i]...)
+				cmd = cmd[i+1:]
+				break
+			}
+		}
+	}
+	if shallow {
+		var err error
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "recursive" || f.Name == "r" {
+				err = errors.New("both --shallow and --recursive were given, use only one of them")
+			}
+		})
 		if err != nil {
-			log.Printf("Error: %s", err)
+			return Options{}, err
 		}
-		log.Printf("Done.")
-	} else {
-		log.Printf("No command to run.")
 	}
+	cliPatterns = append([]string(nil), patternList...)
+	cliFiles = append([]string(nil), fileList...)
+	cliExcludes = append([]string(nil), excludeList...)
+	LoadConfig()
+	if shallow {
+		recursive = false
+	}
+	if err := logger.SetOutput(logFile); err != nil {
+		configErrorf("Using stderr instead", "Unable to open the log file: %v", err)
+	}
+	if err := logger.SetFormat(logFormat); err != nil {
+		configErrorf("Using text instead", "Invalid log format: %s", logFormat)
+	}
+	if err := logger.SetColor(color); err != nil {
+		configErrorf("Using auto instead", "Invalid color mode: %s", color)
+		logger.SetColor("auto")
+	}
+	// Asking for more details wins over asking for less
+	logger.Quiet = quiet && verbose == 0
+	warnDeprecated()
+	if patternsFrom != "" {
+		patterns, err := readPatternsFrom(patternsFrom)
+		if err != nil {
+			return Options{}, fmt.Errorf("unable to read patterns from %s: %v", patternsFrom, err)
+		}
+		patternList = append(patternList, patterns...)
+	}
+	loadIgnoreFile()
+	if commandFile != "" && len(cmd) > 0 {
+		return Options{}, fmt.Errorf("both --command-file %s and a command %v were given, use only one of them", commandFile, cmd)
+	}
+	if err := checkShell(); err != nil {
+		return Options{}, err
+	}
+	opts := options()
+	if configErr != nil {
+		return Options{}, configErr
+	}
+	return opts, nil
 }
 
-func IsDir(path string) bool {
-	s, err := os.Stat(path)
+// options returns the Options given with the command line flags and
+// the configuration file.
+func options() Options {
+	o := Options{
+		Patterns:           patternList,
+		Files:              fileList,
+		Exclude:            excludeList,
+		Include:            includeList,
+		Gitignore:          useGitignore,
+		Recursive:          recursive,
+		FollowSymlinks:     followSymlinks,
+		WatchHidden:        watchHidden,
+		Poll:               poll,
+		CoalesceSaves:      coalesceSaves,
+		DebouncePerCommand: debouncePerCommand,
+		CheckMtime:         checkMtime,
+		WatchMtimeOnly:     watchMtimeOnly,
+		MinSize:            parseSize(minSizeSpec),
+		MaxSize:            parseSize(maxSizeSpec),
+		MaxWatches:         maxWatches,
+		DirWatchOnly:       dirWatchOnly,
+		Shell:              shell,
+		NoShell:            noShell,
+		ShellArgs:          strings.Fields(shellArgs),
+		Command:            cmd,
+		CommandFile:        commandFile,
+		WatchCommandFile:   watchCommandFile,
+		Rules:              ruleList,
+		FirstMatch:         firstMatch,
+		WorkingDir:         workingDir,
+		AbsolutePaths:      absolutePaths,
+		PTY:                pty,
+		EnvFile:            envFile,
+		StdinFile:          stdinFile,
+		InheritStdin:       !stdinNull,
+		Pre:                pre,
+		Post:               post,
+		OnError:            onError,
+		Prefix:             prefix,
+		StateFile:          stateFile,
+		Restart:            restart,
+		IgnoreDuringRun:    ignoreDuringRun,
+		Timeout:            timeout,
+		Grace:              grace,
+		Parallel:           parallel,
+		Retries:            retries,
+		RetryDelay:         retryDelay,
+		FailFast:           failFast,
+		ResetFile:          resetFile,
+		Once:               once,
+		Notify:             notifyDone,
+		DryRun:             dryRun,
+		List:               list,
+		Batch:              batch,
+		FilesToStdin:       filesToStdin,
+		FilesTmpfile:       filesTmpfile,
+		GroupByDir:         groupByDir,
+		WatchNewOnly:       watchNewOnly,
+		RunOnStart:         runOnStart,
+		HTTPAddr:           httpAddr,
+		MetricsAddr:        metricsAddr,
+		Verbosity:          int(verbose),
+		Trace:              trace,
+		SummaryOnExit:      summaryOnExit,
+		Heartbeat:          heartbeat,
+		Jitter:             jitter,
+	}
+	// Patterns can have their own delay, as in 'assets/*.png:delay=2s'
+	o.Patterns = nil
+	for _, p := range patternList {
+		pattern, d, err := SplitPatternDelay(p)
+		if err != nil {
+			configErrorf("Using --delay instead", "Invalid delay for pattern %s", p)
+		}
+		if d != nil {
+			o.Delays = append(o.Delays, PatternDelay{Pattern: pattern, Delay: *d})
+		}
+		o.Patterns = append(o.Patterns, pattern)
+	}
+	if len(o.Patterns) < 1 && len(o.Files) < 1 && len(o.Rules) < 1 {
+		o.Patterns = []string{"./"}
+	}
+
+	delay, err := ParseDelay(delaySpec)
 	if err != nil {
-		log.Printf("Unable to stat %s: %v", path, err)
-		return false
+		configErrorf("Using 5s instead", "Invalid duration: %s", delaySpec)
+		delay = 5 * time.Second
 	}
-	return s.IsDir()
-}
+	o.MinInterval = parseDelay(minIntervalSpec, delay)
+	o.Settle = parseDelay(settleSpec, delay)
 
-// Handle any errors when they happend.
-func HandleError(err error) {
-	log.Printf(err.Error())
-}
+	switch debounce {
+	case debounceLeading, debounceTrailing:
+		o.Debounce = debounce
+	default:
+		configErrorf("Using "+debounceLeading+" instead", "Invalid debounce mode: %s", debounce)
+		o.Debounce = debounceLeading
+	}
 
-// Given a file path, all sub directories are returned.
-func SubDirs(path string) []string {
-	var paths []string
-	filepath.Walk(path, func(newPath string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	o.Events, err = ParseEventTypes(eventSpec)
+	if err != nil {
+		configErrorf("Using "+defaultEvents+" instead", "Invalid events: %v", err)
+		o.Events, _ = ParseEventTypes(defaultEvents)
+	}
+
+	if since != "" {
+		if o.Since, err = ParseSince(since, time.Now()); err != nil {
+			configErrorf("Not running for files modified before startup", "Invalid time: %s", since)
 		}
-		if info.IsDir() {
-			paths = append(paths, newPath)
+	}
+	return o
+}
+
+// First invalid option found with --strict, returned by parseFlags
+var configErr error
+
+// configErrorf logs an invalid option, and the fallback used instead,
+// such as its default. With --strict, the first one is kept instead, for
+// parseFlags to fail with, so that a typo does not go unnoticed, as in CI.
+func configErrorf(fallback, format string, args ...interface{}) {
+	if strict {
+		if configErr == nil {
+			configErr = fmt.Errorf(format, args...)
 		}
-		return nil
-	})
-	return paths
+		return
+	}
+	errorf("config", nil, format+". "+fallback, args...)
+}
+
+// parseDelay parses spec, given for one of the delays, using delay from
+// --delay instead if not given or invalid.
+func parseDelay(spec string, delay time.Duration) time.Duration {
+	if spec == "" {
+		return delay
+	}
+	d, err := ParseDelay(spec)
+	if err != nil {
+		configErrorf("Using "+delay.String()+" instead", "Invalid duration: %s", spec)
+		return delay
+	}
+	return d
+}
+
+// parseSize parses spec, given for --min-size or --max-size, returning 0,
+// no limit, if not given or invalid.
+func parseSize(spec string) int64 {
+	if spec == "" {
+		return 0
+	}
+	n, err := ParseSize(spec)
+	if err != nil {
+		configErrorf("Not limiting the file size", "Invalid size: %s", spec)
+		return 0
+	}
+	return n
 }
 
-func verbosef(f string, args ...interface{}) {
-	if verbose {
-		log.Printf(f, args...)
+// envDefault returns the value of the environment variable name, to use
+// as the default of a flag, or value if it is not set.
+func envDefault(name, value string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
 	}
+	return value
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parseArgs calls parseFlags with args given on the command line, with
+// the flags defined again, from an empty directory so that no
+// configuration or ignore file is read.
+func parseArgs(t *testing.T, args ...string) (Options, error) {
+	t.Helper()
+	chdirTemp(t)
+	oldArgs := os.Args
+	t.Cleanup(func() { os.Args = oldArgs })
+	os.Args = append([]string{"whenchange"}, args...)
+
+	flag.CommandLine = flag.NewFlagSet("whenchange", flag.ContinueOnError)
+	flag.CommandLine.SetOutput(io.Discard)
+	patternList, fileList, excludeList, includeList, ruleList, cmd = nil, nil, nil, nil, nil, nil
+	verbose, configErr, usedDeprecated = 0, nil, nil
+	defineFlags()
+	return parseFlags()
+}
+
+func TestParseFlagsErrors(t *testing.T) {
+	captureLog(t)
+	for _, tc := range []struct {
+		name string
+		args []string
+		err  string
+	}{
+		{"unknown flag", []string{"--bogus", "true"}, "flag provided but not defined: -bogus"},
+		{"invalid delay", []string{"--strict", "--delay", "soon", "true"}, "Invalid duration: soon"},
+		{"unknown delay unit", []string{"--strict", "--delay", "2 fortnights", "true"}, "Invalid duration: 2 fortnights"},
+		{"delay without number", []string{"--strict", "-d", "seconds", "true"}, "Invalid duration: seconds"},
+		{"delay without unit", []string{"--strict", "-d", "1 minute and 30", "true"}, "Invalid duration: 1 minute and 30"},
+		{"invalid settle", []string{"--strict", "--settle", "a while", "true"}, "a while"},
+		{"shallow and recursive", []string{"--shallow", "--recursive", "true"}, "both --shallow and --recursive were given"},
+		{"command file and command", []string{"--command-file", "build.sh", "true"}, "both --command-file build.sh and a command"},
+		{"missing patterns file", []string{"--patterns-from", "missing.txt", "true"}, "unable to read patterns from missing.txt"},
+		{"missing shell", []string{"--shell", "no-such-shell", "true"}, "unable to find the shell"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseArgs(t, tc.args...)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("parseFlags() with %q returned %v, expected %q", tc.args, err, tc.err)
+			}
+		})
+	}
+}
+
+func TestParseFlagsDelayPhrase(t *testing.T) {
+	captureLog(t)
+	opts, err := parseArgs(t, "--strict", "--shell", "sh", "--delay", "1 minute and 30 seconds", "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.MinInterval != 90*time.Second {
+		t.Errorf("Delay parsed as %s, expected 1m30s", opts.MinInterval)
+	}
+	// Invalid, but not fatal without --strict
+	opts, err = parseArgs(t, "--shell", "sh", "--delay", "soon", "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.MinInterval != 5*time.Second {
+		t.Errorf("Invalid delay replaced by %s, expected 5s", opts.MinInterval)
+	}
+}
+
+func TestDeprecatedFlagWarning(t *testing.T) {
+	captureLog(t)
+	logFile := filepath.Join(t.TempDir(), "whenchange.log")
+	t.Cleanup(func() {
+		if f, ok := logger.out.(*os.File); ok && f != os.Stderr {
+			f.Close()
+		}
+		logger.SetOutput("-")
+		logger.SetFormat("text")
+	})
+	_, err := parseArgs(t, "--shell", "sh", "--log-format", "json", "--log-file", logFile, "--pattners", "*.go", "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal(b, &entry); err != nil {
+		t.Fatalf("Warning not logged as JSON: %v\n%s", err, b)
+	}
+	for key, want := range map[string]string{"level": "warn", "event": "flag", "flag": "pattners", "replacement": "patterns"} {
+		if got := entry[key]; got != want {
+			t.Errorf("Logged %s: %v, expected %s", key, got, want)
+		}
+	}
+}